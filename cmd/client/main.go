@@ -1,10 +1,18 @@
 package main
 
 import (
+	"fmt"
+	"os"
+
 	"github.com/b41sh/ikv/internal"
 )
 
 func main() {
-	client := internal.NewClient()
+	cfg, err := internal.LoadConfig("client", os.Args[1:])
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(internal.ExitCode(err))
+	}
+	client := internal.NewClient(cfg)
 	client.Run()
 }
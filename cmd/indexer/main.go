@@ -1,10 +1,25 @@
 package main
 
 import (
+	"fmt"
+	"os"
+
 	"github.com/b41sh/ikv/internal"
 )
 
 func main() {
-	indexer := internal.NewIndexer()
-	indexer.Run()
+	cfg, err := internal.LoadConfig("indexer", os.Args[1:])
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(internal.ExitCode(err))
+	}
+	indexer, err := internal.NewIndexer(cfg)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(internal.ExitCode(err))
+	}
+	if err := indexer.Run(); err != nil {
+		fmt.Println(err)
+		os.Exit(internal.ExitCode(err))
+	}
 }
@@ -1,10 +1,25 @@
 package main
 
 import (
+	"fmt"
+	"os"
+
 	"github.com/b41sh/ikv/internal"
 )
 
 func main() {
-	server, _ := internal.NewServer()
-	server.Run()
+	cfg, err := internal.LoadConfig("server", os.Args[1:])
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(internal.ExitCode(err))
+	}
+	server, err := internal.NewServer(cfg)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(internal.ExitCode(err))
+	}
+	if err := server.Run(); err != nil {
+		fmt.Println(err)
+		os.Exit(internal.ExitCode(err))
+	}
 }
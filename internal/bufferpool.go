@@ -0,0 +1,217 @@
+package internal
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	defaultBufferPoolSize = 512 * 1024 * 1024
+	bufferPoolGhostRatio  = 4
+	bufferPoolMinGhost    = 64
+)
+
+// load a page into buf
+type PageLoader func(pageId uint64, buf []byte) error
+
+// a page in buffer pool
+// a frame is pinned while it is read, pinned frames are never evicted
+type Frame struct {
+	pageId uint64
+	buf    []byte
+	pins   int32
+	ready  chan struct{}
+	err    error
+}
+
+// page data, only valid while the frame is pinned
+func (f *Frame) Buf() []byte {
+	return f.buf
+}
+
+type BufferPoolStats struct {
+	Size      uint64
+	Used      uint64
+	Pages     uint64
+	Hits      uint64
+	Misses    uint64
+	Admits    uint64
+	Evicts    uint64
+	Bypasses  uint64
+	GhostHits uint64
+}
+
+// buffer pool of recently read value pages
+// pages are managed by 2Q, which is scan resistant
+//
+// a page seen for the first time is not loaded, its id is remembered in
+// the ghost queue (A1out) and the value is read from disk directly.
+// a page referenced again while its id is still in the ghost queue is
+// loaded and put into the LRU queue (Am), the least recently used
+// unpinned page is evicted when the memory budget is exceeded.
+// so a scan over many pages never evicts the hot pages
+type BufferPool struct {
+	mu       sync.Mutex
+	pageSize uint64
+	maxPages int
+	maxGhost int
+	load     PageLoader
+
+	frames map[uint64]*list.Element
+	am     *list.List
+	ghosts map[uint64]*list.Element
+	a1out  *list.List
+
+	hits      uint64
+	misses    uint64
+	admits    uint64
+	evicts    uint64
+	bypasses  uint64
+	ghostHits uint64
+}
+
+// size is the memory budget of the pool in bytes,
+// the pool is disabled if it can not hold one page
+func NewBufferPool(size, pageSize uint64, load PageLoader) *BufferPool {
+	maxPages := int(size / pageSize)
+	maxGhost := maxPages * bufferPoolGhostRatio
+	if maxGhost < bufferPoolMinGhost {
+		maxGhost = bufferPoolMinGhost
+	}
+
+	return &BufferPool{
+		pageSize: pageSize,
+		maxPages: maxPages,
+		maxGhost: maxGhost,
+		load:     load,
+		frames:   make(map[uint64]*list.Element),
+		am:       list.New(),
+		ghosts:   make(map[uint64]*list.Element),
+		a1out:    list.New(),
+	}
+}
+
+// get a pinned frame of page
+// return nil if the page is not in pool and not admitted,
+// the caller should read from disk then
+// a frame returned must be released by Unpin
+func (p *BufferPool) Fetch(pageId uint64) (*Frame, error) {
+	if p.maxPages == 0 {
+		return nil, nil
+	}
+
+	p.mu.Lock()
+	if e, ok := p.frames[pageId]; ok {
+		f := e.Value.(*Frame)
+		f.pins++
+		p.am.MoveToFront(e)
+		p.mu.Unlock()
+		atomic.AddUint64(&p.hits, 1)
+
+		// the page may be loading by another reader
+		<-f.ready
+		if f.err != nil {
+			p.Unpin(f)
+			return nil, f.err
+		}
+		return f, nil
+	}
+	atomic.AddUint64(&p.misses, 1)
+
+	g, ok := p.ghosts[pageId]
+	if !ok {
+		p.remember(pageId)
+		p.mu.Unlock()
+		return nil, nil
+	}
+	atomic.AddUint64(&p.ghostHits, 1)
+
+	buf := p.reserve()
+	if buf == nil {
+		p.mu.Unlock()
+		atomic.AddUint64(&p.bypasses, 1)
+		return nil, nil
+	}
+	p.a1out.Remove(g)
+	delete(p.ghosts, pageId)
+	f := &Frame{
+		pageId: pageId,
+		buf:    buf,
+		pins:   1,
+		ready:  make(chan struct{}),
+	}
+	p.frames[pageId] = p.am.PushFront(f)
+	p.mu.Unlock()
+	atomic.AddUint64(&p.admits, 1)
+
+	// load outside the lock, other readers of the page wait on ready
+	f.err = p.load(pageId, f.buf)
+	close(f.ready)
+	if f.err != nil {
+		p.mu.Lock()
+		if e, ok := p.frames[pageId]; ok && e.Value == f {
+			p.am.Remove(e)
+			delete(p.frames, pageId)
+		}
+		p.mu.Unlock()
+		return nil, f.err
+	}
+	return f, nil
+}
+
+// release a frame returned by Fetch
+func (p *BufferPool) Unpin(f *Frame) {
+	p.mu.Lock()
+	f.pins--
+	p.mu.Unlock()
+}
+
+func (p *BufferPool) Stats() BufferPoolStats {
+	p.mu.Lock()
+	pages := uint64(len(p.frames))
+	p.mu.Unlock()
+
+	return BufferPoolStats{
+		Size:      uint64(p.maxPages) * p.pageSize,
+		Used:      pages * p.pageSize,
+		Pages:     pages,
+		Hits:      atomic.LoadUint64(&p.hits),
+		Misses:    atomic.LoadUint64(&p.misses),
+		Admits:    atomic.LoadUint64(&p.admits),
+		Evicts:    atomic.LoadUint64(&p.evicts),
+		Bypasses:  atomic.LoadUint64(&p.bypasses),
+		GhostHits: atomic.LoadUint64(&p.ghostHits),
+	}
+}
+
+// remember a page id in ghost queue, must hold the lock
+func (p *BufferPool) remember(pageId uint64) {
+	p.ghosts[pageId] = p.a1out.PushFront(pageId)
+	if p.a1out.Len() > p.maxGhost {
+		e := p.a1out.Back()
+		p.a1out.Remove(e)
+		delete(p.ghosts, e.Value.(uint64))
+	}
+}
+
+// get a buffer for a new page, must hold the lock
+// the least recently used unpinned page is evicted if pool is full,
+// its buffer is reused, return nil if all pages are pinned
+func (p *BufferPool) reserve() []byte {
+	if len(p.frames) < p.maxPages {
+		return make([]byte, p.pageSize)
+	}
+	for e := p.am.Back(); e != nil; e = e.Prev() {
+		f := e.Value.(*Frame)
+		if f.pins > 0 {
+			continue
+		}
+		p.am.Remove(e)
+		delete(p.frames, f.pageId)
+		p.remember(f.pageId)
+		atomic.AddUint64(&p.evicts, 1)
+		return f.buf
+	}
+	return nil
+}
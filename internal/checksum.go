@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+)
+
+const (
+	checksumSize = 4
+)
+
+// pages and records are protected by crc32c,
+// which is computed by hardware on most cpus
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+func checksum(data []byte) uint32 {
+	return crc32.Checksum(data, crcTable)
+}
+
+// verify data against the big endian checksum in sum
+// what and offset are only used in the error
+func verifyChecksum(data, sum []byte, what string, offset uint64) error {
+	if checksum(data) != binary.BigEndian.Uint32(sum) {
+		return newCorruptError("%s checksum mismatch at offset %d", what, offset)
+	}
+	return nil
+}
+
+// checksum of the concatenation of data1 and data2,
+// crc1 is the checksum of data1, crc2 is the checksum of data2 of size len2
+// it is crc32_combine of zlib, so a file is not read again to get its checksum
+func combineChecksum(crc1, crc2 uint32, len2 uint64) uint32 {
+	if len2 == 0 {
+		return crc1
+	}
+
+	// operator of one zero bit
+	even := make([]uint32, 32)
+	odd := make([]uint32, 32)
+	odd[0] = crc32.Castagnoli
+	row := uint32(1)
+	for n := 1; n < 32; n++ {
+		odd[n] = row
+		row <<= 1
+	}
+	// operator of two and four zero bits
+	gf2MatrixSquare(even, odd)
+	gf2MatrixSquare(odd, even)
+
+	// apply len2 zero bytes to crc1
+	for {
+		gf2MatrixSquare(even, odd)
+		if len2&1 != 0 {
+			crc1 = gf2MatrixTimes(even, crc1)
+		}
+		len2 >>= 1
+		if len2 == 0 {
+			break
+		}
+		gf2MatrixSquare(odd, even)
+		if len2&1 != 0 {
+			crc1 = gf2MatrixTimes(odd, crc1)
+		}
+		len2 >>= 1
+		if len2 == 0 {
+			break
+		}
+	}
+	return crc1 ^ crc2
+}
+
+func gf2MatrixTimes(mat []uint32, vec uint32) uint32 {
+	sum := uint32(0)
+	for i := 0; vec != 0; i++ {
+		if vec&1 != 0 {
+			sum ^= mat[i]
+		}
+		vec >>= 1
+	}
+	return sum
+}
+
+func gf2MatrixSquare(square, mat []uint32) {
+	for n := 0; n < 32; n++ {
+		square[n] = gf2MatrixTimes(mat, mat[n])
+	}
+}
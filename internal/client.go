@@ -9,35 +9,93 @@ import (
 )
 
 type Client struct {
+	cfg *Config
 }
 
-func NewClient() *Client {
-	return &Client{}
+func NewClient(cfg *Config) *Client {
+	return &Client{cfg: cfg}
 }
 
 // run client connect to server and get value
+// commands are parsed by splitArgs and sent as RESP arrays,
+// so keys and values may contain any byte
 func (c *Client) Run() {
 
-	port := "127.0.0.1:6379"
-	conn, err := net.Dial("tcp", port)
+	conn, err := net.Dial("tcp", c.cfg.Addr)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
+	defer conn.Close()
 
+	stdin := bufio.NewReader(os.Stdin)
+	r := NewRespReader(bufio.NewReaderSize(conn, respIOBufSize))
+	w := NewRespWriter(bufio.NewWriterSize(conn, respIOBufSize))
 	for {
-		reader := bufio.NewReader(os.Stdin)
 		fmt.Print(">>> ")
-		cmd, _ := reader.ReadString('\n')
-		if strings.TrimSpace(string(cmd)) == "" {
+		cmd, err := stdin.ReadString('\n')
+		if err != nil {
+			fmt.Println()
+			return
+		}
+		cmd = strings.TrimSpace(cmd)
+		if cmd == "" {
 			continue
 		}
-		if strings.TrimSpace(string(cmd)) == "exit" {
+		if cmd == "exit" {
 			fmt.Println("client exiting...")
 			return
 		}
-		fmt.Fprintf(conn, cmd+"\n")
-		resp, _ := bufio.NewReader(conn).ReadString('\n')
-		fmt.Print(resp)
+		args, err := splitArgs([]byte(cmd))
+		if err != nil {
+			fmt.Printf("Invalid argument(s): %s\n", err)
+			continue
+		}
+		if err := w.WriteCommand(args); err != nil {
+			fmt.Println(err)
+			return
+		}
+		if err := w.Flush(); err != nil {
+			fmt.Println(err)
+			return
+		}
+		reply, err := r.ReadReply()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		printReply(reply, "")
+	}
+}
+
+// print a reply the way redis-cli does
+// bulk strings are quoted and escaped, see quoteArg
+func printReply(reply *RespReply, indent string) {
+	switch reply.Type {
+	case respError:
+		fmt.Printf("(error) %s\n", reply.Str)
+	case respSimpleString:
+		fmt.Printf("%s\n", reply.Str)
+	case respInteger:
+		fmt.Printf("(integer) %d\n", reply.Int)
+	case respBulkString:
+		if reply.Null {
+			fmt.Println("(nil)")
+			return
+		}
+		fmt.Println(quoteArg(reply.Str))
+	case respArray:
+		if reply.Null || len(reply.Array) == 0 {
+			fmt.Println("(empty array)")
+			return
+		}
+		for i, elem := range reply.Array {
+			if i > 0 {
+				fmt.Print(indent)
+			}
+			prefix := fmt.Sprintf("%d) ", i+1)
+			fmt.Print(prefix)
+			printReply(elem, indent+strings.Repeat(" ", len(prefix)))
+		}
 	}
 }
@@ -0,0 +1,160 @@
+package internal
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultListenAddr = ":6379"
+	defaultServerAddr = "127.0.0.1:6379"
+	configEnvPrefix   = "IKV_"
+	minIdxPageSize    = 4 * 1024
+	minValPageSize    = 4 * 1024
+)
+
+// config shared by server, indexer and client
+//
+// options are loaded in order, a later one overrides an earlier one
+//
+//  1. default value
+//  2. json config file given by -config
+//  3. environment variable, IKV_ followed by the flag name in upper case
+//     with '-' replaced by '_', for example IKV_IDX_PAGE_SIZE
+//  4. command line flag, for example -idx-page-size
+//
+// sizes are in bytes
+type Config struct {
+	DataPath       string `json:"data_path"`
+	StoreDir       string `json:"store_dir"`
+	Listen         string `json:"listen"`
+	Addr           string `json:"addr"`
+	IdxPageSize    uint64 `json:"idx_page_size"`
+	ValPageSize    uint64 `json:"val_page_size"`
+	SegmentSize    uint64 `json:"segment_size"`
+	BufferPoolSize uint64 `json:"buffer_pool_size"`
+	ValueCacheSize uint64 `json:"value_cache_size"`
+	MaxKeySize     uint64 `json:"max_key_size"`
+	IndexShards    uint64 `json:"index_shards"`
+	IndexType      string `json:"index_type"`
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		DataPath:       defaultDataFilePath,
+		StoreDir:       defaultStoreDir,
+		Listen:         defaultListenAddr,
+		Addr:           defaultServerAddr,
+		IdxPageSize:    defaultIdxPageSize,
+		ValPageSize:    defaultValPageSize,
+		SegmentSize:    defaultSegmentSize,
+		BufferPoolSize: defaultBufferPoolSize,
+		ValueCacheSize: defaultValueCacheSize,
+		MaxKeySize:     defaultMaxKeySize,
+		IndexShards:    defaultIndexShards,
+		IndexType:      defaultIndexType,
+	}
+}
+
+// bind every option to a flag
+// the flag names are also used to build the environment variable names
+func (c *Config) bindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.DataPath, "data-path", c.DataPath, "original data file read by indexer")
+	fs.StringVar(&c.StoreDir, "store-dir", c.StoreDir, "directory of index and value segments")
+	fs.StringVar(&c.Listen, "listen", c.Listen, "address server listens on")
+	fs.StringVar(&c.Addr, "addr", c.Addr, "address of server client connects to")
+	fs.Uint64Var(&c.IdxPageSize, "idx-page-size", c.IdxPageSize, "size of index page")
+	fs.Uint64Var(&c.ValPageSize, "val-page-size", c.ValPageSize, "size of value page")
+	fs.Uint64Var(&c.SegmentSize, "segment-size", c.SegmentSize, "size a value segment file is rolled at")
+	fs.Uint64Var(&c.BufferPoolSize, "buffer-pool-size", c.BufferPoolSize, "memory of value page buffer pool, 0 disables it")
+	fs.Uint64Var(&c.ValueCacheSize, "value-cache-size", c.ValueCacheSize, "memory of hot value cache, 0 disables it")
+	fs.Uint64Var(&c.MaxKeySize, "max-key-size", c.MaxKeySize, "largest key accepted by indexer")
+	fs.Uint64Var(&c.IndexShards, "index-shards", c.IndexShards, "number of shards of in-memory index")
+	fs.StringVar(&c.IndexType, "index-type", c.IndexType, "type of in-memory index, art, hash, sorted or mph")
+}
+
+// load config of command name from args, see Config
+func LoadConfig(name string, args []string) (*Config, error) {
+	var path string
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(&path, "config", "", "json config file")
+	DefaultConfig().bindFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, configError(err)
+	}
+	if fs.NArg() > 0 {
+		return nil, newConfigError("unexpected argument '%s'", fs.Arg(0))
+	}
+
+	cfg := DefaultConfig()
+	if path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return nil, configError(err)
+		}
+	}
+
+	// set options on a flag set bound to cfg,
+	// environment variables first, then the flags given
+	cfs := flag.NewFlagSet(name, flag.ContinueOnError)
+	cfg.bindFlags(cfs)
+	var err error
+	cfs.VisitAll(func(f *flag.Flag) {
+		env := configEnvPrefix + strings.ToUpper(strings.Replace(f.Name, "-", "_", -1))
+		if v, ok := os.LookupEnv(env); ok && err == nil {
+			if e := cfs.Set(f.Name, v); e != nil {
+				err = errors.Wrapf(e, "invalid value of %s", env)
+			}
+		}
+	})
+	if err != nil {
+		return nil, configError(err)
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name != "config" {
+			_ = cfs.Set(f.Name, f.Value.String())
+		}
+	})
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.Wrap(err, "failed reading config file")
+	}
+	if err := json.Unmarshal(data, c); err != nil {
+		return errors.Wrapf(err, "failed parsing config file %s", path)
+	}
+	return nil
+}
+
+func (c *Config) Validate() error {
+	if c.IdxPageSize < minIdxPageSize || c.IdxPageSize > 1<<32-1 {
+		return newConfigError("idx_page_size must be between %d and %d", minIdxPageSize, uint64(1<<32-1))
+	}
+	if c.ValPageSize < minValPageSize || c.ValPageSize > posMaxOffset {
+		return newConfigError("val_page_size must be between %d and %d", minValPageSize, uint64(posMaxOffset))
+	}
+	if c.SegmentSize < c.ValPageSize || c.SegmentSize > posMaxOffset+1 {
+		return newConfigError("segment_size must be between val_page_size and %d", uint64(posMaxOffset+1))
+	}
+	if c.MaxKeySize == 0 || c.MaxKeySize > 1<<32-1 {
+		return newConfigError("max_key_size must be between 1 and %d", uint64(1<<32-1))
+	}
+	if c.IndexShards == 0 || c.IndexShards > maxIndexShards {
+		return newConfigError("index_shards must be between 1 and %d", maxIndexShards)
+	}
+	if !validIndexType(c.IndexType) {
+		return newConfigError("index_type must be %s, %s, %s or %s", indexTypeArt, indexTypeHash, indexTypeSorted, indexTypeMph)
+	}
+	return nil
+}
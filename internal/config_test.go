@@ -0,0 +1,103 @@
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// set environment variable key until the test ends
+func setTestEnv(t *testing.T, key, value string) {
+	old, ok := os.LookupEnv(key)
+	os.Setenv(key, value)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+// an option is taken from default, file, env and flag in that order
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := ioutil.WriteFile(path, []byte(`{"val_page_size": 8192, "index_type": "hash"}`), 0640); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name string
+		file bool
+		env  string
+		flag string
+		want uint64
+	}{
+		{"default", false, "", "", defaultValPageSize},
+		{"file", true, "", "", 8192},
+		{"env", true, "16384", "", 16384},
+		{"flag", true, "16384", "32768", 32768},
+		{"flag without env", true, "", "32768", 32768},
+		{"env without file", false, "16384", "", 16384},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			args := []string{}
+			if c.file {
+				args = append(args, "-config", path)
+			}
+			if c.env != "" {
+				setTestEnv(t, "IKV_VAL_PAGE_SIZE", c.env)
+			}
+			if c.flag != "" {
+				args = append(args, "-val-page-size", c.flag)
+			}
+			cfg, err := LoadConfig("test", args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.ValPageSize != c.want {
+				t.Errorf("ValPageSize = %d, want %d", cfg.ValPageSize, c.want)
+			}
+			// options not overridden keep the value of file
+			wantType := defaultIndexType
+			if c.file {
+				wantType = indexTypeHash
+			}
+			if cfg.IndexType != wantType {
+				t.Errorf("IndexType = %s, want %s", cfg.IndexType, wantType)
+			}
+		})
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	cases := []struct {
+		name string
+		env  string
+		val  string
+		args []string
+	}{
+		{"env not a number", "IKV_VAL_PAGE_SIZE", "big", nil},
+		{"env out of bounds", "IKV_VAL_PAGE_SIZE", "1024", nil},
+		{"env bad index type", "IKV_INDEX_TYPE", "btree", nil},
+		{"flag out of bounds", "", "", []string{"-index-shards", "0"}},
+		{"segment below page", "", "", []string{"-val-page-size", "8192", "-segment-size", "4096"}},
+		{"unknown flag", "", "", []string{"-no-such-flag"}},
+		{"argument", "", "", []string{"extra"}},
+		{"no config file", "", "", []string{"-config", filepath.Join(t.TempDir(), "none.json")}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if c.env != "" {
+				setTestEnv(t, c.env, c.val)
+			}
+			_, err := LoadConfig("test", c.args)
+			if !errors.Is(err, ErrConfig) || ExitCode(err) != exitConfig {
+				t.Errorf("LoadConfig error %v, want ErrConfig", err)
+			}
+		})
+	}
+}
@@ -1,41 +1,42 @@
 package internal
 
 import (
-	"errors"
 	"golang.org/x/exp/mmap"
 
 	"encoding/binary"
+	"io"
+	"io/ioutil"
 )
 
 const (
-	originalFilePath = "/tmp/org.data"
+	defaultDataFilePath = "/tmp/org.data"
+	dataChunkSize       = 1024 * 1024
+	defaultMaxKeySize   = 64 * 1024
 )
 
 // read data from original file
+// DataReader is safe for concurrent use
 type DataReader struct {
 	reader *mmap.ReaderAt
 	l      int64
-	buf    []byte
 }
 
-func NewDataReader() (*DataReader, error) {
-	reader, err := mmap.Open(originalFilePath)
+func NewDataReader(path string) (*DataReader, error) {
+	reader, err := mmap.Open(path)
 	if err != nil {
 		return &DataReader{}, err
 	}
 
 	l := int64(reader.Len())
-	buf := make([]byte, 1024*1024)
 
 	return &DataReader{
 		reader: reader,
 		l:      l,
-		buf:    buf,
 	}, nil
 }
 
 func (d *DataReader) ReadAt(size, offset uint64) ([]byte, error) {
-	buf := d.buf[0:size]
+	buf := make([]byte, size)
 	_, err := d.reader.ReadAt(buf, int64(offset))
 	if err != nil {
 		return nil, err
@@ -44,7 +45,8 @@ func (d *DataReader) ReadAt(size, offset uint64) ([]byte, error) {
 }
 
 // stream read original file
-// once read a chunk into buf and then loop through
+// once read a chunk into buf and then loop through,
+// a field may span any number of chunks
 //
 // file format is as follow
 //
@@ -53,21 +55,24 @@ func (d *DataReader) ReadAt(size, offset uint64) ([]byte, error) {
 // |  uint32  | []byte |   uint64   | []byte |
 // +----------+--------+------------+--------+
 //
+// a key larger than maxKeySize is rejected
 type DataStreamReader struct {
-	reader *mmap.ReaderAt
-	l      int64
-	off    int64
-	roff   int
-	cnt    int
-	buf    []byte
-	ksbuf  []byte
-	vsbuf  []byte
-	kbuf   []byte
-	vbuf   []byte
-}
-
-func NewDataStreamReader() (*DataStreamReader, error) {
-	reader, err := mmap.Open(originalFilePath)
+	reader     *mmap.ReaderAt
+	l          int64
+	off        int64
+	roff       int
+	n          int
+	cnt        int
+	maxKeySize uint32
+	buf        []byte
+	ksbuf      []byte
+	vsbuf      []byte
+	kbuf       []byte
+	vbuf       []byte
+}
+
+func NewDataStreamReader(path string, maxKeySize uint32) (*DataStreamReader, error) {
+	reader, err := mmap.Open(path)
 	if err != nil {
 		return &DataStreamReader{}, err
 	}
@@ -75,7 +80,8 @@ func NewDataStreamReader() (*DataStreamReader, error) {
 	l := int64(reader.Len())
 	off := int64(0)
 	roff := 0
-	buf := make([]byte, 1024*1024)
+	n := 0
+	buf := make([]byte, dataChunkSize)
 	ksbuf := make([]byte, 4)
 	vsbuf := make([]byte, 8)
 	kbuf := make([]byte, 1024)
@@ -83,40 +89,30 @@ func NewDataStreamReader() (*DataStreamReader, error) {
 	cnt := 0
 
 	return &DataStreamReader{
-		reader: reader,
-		l:      l,
-		off:    off,
-		roff:   roff,
-		cnt:    cnt,
-		buf:    buf,
-		ksbuf:  ksbuf,
-		vsbuf:  vsbuf,
-		kbuf:   kbuf,
-		vbuf:   vbuf,
+		reader:     reader,
+		l:          l,
+		off:        off,
+		roff:       roff,
+		n:          n,
+		cnt:        cnt,
+		maxKeySize: maxKeySize,
+		buf:        buf,
+		ksbuf:      ksbuf,
+		vsbuf:      vsbuf,
+		kbuf:       kbuf,
+		vbuf:       vbuf,
 	}, nil
 }
 
 // read key_size
+// return io.EOF at the end of file
 func (d *DataStreamReader) ReadKeySize() (uint32, error) {
-	start := 0
-	end := 4
-	if d.roff+end > 1024*1024 {
-		koff := copy(d.ksbuf, d.buf[d.roff:])
-		start += koff
-		end -= koff
-		d.roff += koff
-	}
-	if d.roff == 0 || d.roff == 1024*1024 {
-		n, err := d.read()
-		if n == 0 {
-			return uint32(0), errors.New("EOF")
-		}
-		if err != nil {
+	if _, err := io.ReadFull(d, d.ksbuf); err != nil {
+		if err == io.EOF {
 			return uint32(0), err
 		}
+		return uint32(0), unexpectedEOF(err)
 	}
-	copy(d.ksbuf[start:], d.buf[d.roff:d.roff+end])
-	d.roff += end
 
 	keySize := binary.BigEndian.Uint32(d.ksbuf)
 	return keySize, nil
@@ -124,119 +120,120 @@ func (d *DataStreamReader) ReadKeySize() (uint32, error) {
 
 // read value_size
 func (d *DataStreamReader) ReadValueSize() (uint64, error) {
-	start := 0
-	end := 8
-	if d.roff+end > 1024*1024 {
-		koff := copy(d.vsbuf, d.buf[d.roff:])
-		start += koff
-		end -= koff
-		d.roff += koff
-	}
-	if d.roff == 0 || d.roff == 1024*1024 {
-		n, err := d.read()
-		if n == 0 {
-			return uint64(0), errors.New("EOF")
-		}
-		if err != nil {
-			return uint64(0), err
-		}
+	if _, err := io.ReadFull(d, d.vsbuf); err != nil {
+		return uint64(0), unexpectedEOF(err)
 	}
-	copy(d.vsbuf[start:], d.buf[d.roff:d.roff+end])
-	d.roff += end
 
 	valueSize := binary.BigEndian.Uint64(d.vsbuf)
 	return valueSize, nil
 }
 
 // read key
+// the key returned is only valid until next read
 func (d *DataStreamReader) ReadKey(keySize uint32) ([]byte, error) {
+	if keySize > d.maxKeySize {
+		return nil, newConfigError("key size %d at offset %d exceeds max key size %d",
+			keySize, d.GetOffset()-4, d.maxKeySize)
+	}
+	if uint32(len(d.kbuf)) < keySize {
+		d.kbuf = make([]byte, keySize)
+	}
 	ks := int(keySize)
-	start := 0
-	end := int(keySize)
-	if d.roff+end > 1024*1024 {
-		koff := copy(d.kbuf, d.buf[d.roff:])
-		start += koff
-		end -= koff
-		d.roff += koff
-	}
-	if d.roff == 0 || d.roff == 1024*1024 {
-		n, err := d.read()
-		if n == 0 {
-			return nil, errors.New("EOF")
-		}
-		if err != nil {
-			return nil, err
-		}
+	if _, err := io.ReadFull(d, d.kbuf[0:ks]); err != nil {
+		return nil, unexpectedEOF(err)
 	}
-	copy(d.kbuf[start:], d.buf[d.roff:d.roff+end])
-	d.roff += end
 
 	rbuf := d.kbuf[0:ks]
 	return rbuf, nil
 }
 
 // read value
+// the value returned is only valid until next read,
+// a large value should be read by ValueReader
 func (d *DataStreamReader) ReadValue(valueSize uint64) ([]byte, error) {
+	if uint64(len(d.vbuf)) < valueSize {
+		d.vbuf = make([]byte, valueSize)
+	}
 	vs := int(valueSize)
-	start := 0
-	end := int(valueSize)
-	if d.roff+end > 1024*1024 {
-		voff := copy(d.vbuf, d.buf[d.roff:])
-		start += voff
-		end -= voff
-		d.roff += voff
-	}
-	if d.roff == 0 || d.roff == 1024*1024 {
-		n, err := d.read()
-		if n == 0 {
-			return nil, errors.New("EOF")
-		}
-		if err != nil {
-			return nil, err
-		}
+	if _, err := io.ReadFull(d, d.vbuf[0:vs]); err != nil {
+		return nil, unexpectedEOF(err)
 	}
-	copy(d.vbuf[start:], d.buf[d.roff:d.roff+end])
-	d.roff += end
 
 	rbuf := d.vbuf[0:vs]
 	return rbuf, nil
 }
 
-// skip a value
-func (d *DataStreamReader) Skip(valueSize uint64) error {
-	vs := int(valueSize)
-	if d.roff+vs > 1024*1024 {
-		m := 1024*1024 - d.roff
-		n, err := d.read()
-		if n == 0 {
-			return errors.New("EOF")
-		}
-		if err != nil {
-			return err
-		}
-		d.roff = vs - m
-	} else {
-		d.roff += vs
+// stream a value without loading it into memory
+func (d *DataStreamReader) ValueReader(valueSize uint64) io.Reader {
+	return &valueReader{d: d, left: valueSize}
+}
+
+// reader of the rest of a value, like io.LimitReader,
+// but the file ending before the value does is corrupt as in ReadValue
+type valueReader struct {
+	d    *DataStreamReader
+	left uint64
+}
+
+func (r *valueReader) Read(p []byte) (int, error) {
+	if r.left == 0 {
+		return 0, io.EOF
+	}
+	if uint64(len(p)) > r.left {
+		p = p[0:r.left]
 	}
+	n, err := r.d.Read(p)
+	r.left -= uint64(n)
+	if err != nil {
+		return n, unexpectedEOF(err)
+	}
+	return n, nil
+}
 
-	return nil
+// skip a value
+func (d *DataStreamReader) Skip(valueSize uint64) error {
+	_, err := io.CopyN(ioutil.Discard, d, int64(valueSize))
+	return unexpectedEOF(err)
 }
 
+// offset of the next byte to read in file
 func (d *DataStreamReader) GetOffset() uint64 {
-	return uint64(d.off) + uint64(d.roff)
+	return uint64(d.off) - uint64(d.n) + uint64(d.roff)
+}
+
+// read from the chunk in buf, read next chunk if it is consumed
+func (d *DataStreamReader) Read(p []byte) (int, error) {
+	if d.roff == d.n {
+		if _, err := d.read(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.buf[d.roff:d.n])
+	d.roff += n
+	return n, nil
 }
 
 func (d *DataStreamReader) read() (int, error) {
 	if d.off >= d.l {
-		return 0, errors.New("EOF")
+		return 0, io.EOF
 	}
 
+	// the last chunk may be shorter than buf
 	n, err := d.reader.ReadAt(d.buf, d.off)
-	if err != nil {
+	if n == 0 {
 		return 0, err
 	}
 	d.off += int64(n)
 	d.roff = 0
+	d.n = n
 	d.cnt++
 	return n, nil
 }
+
+// the file ends in the middle of a record
+func unexpectedEOF(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return &kindError{kind: ErrCorrupt, msg: "data file ends in the middle of a record", err: io.ErrUnexpectedEOF}
+	}
+	return ioError(err)
+}
@@ -3,84 +3,427 @@ package internal
 import (
 	"errors"
 	"fmt"
-	art "github.com/plar/go-adaptive-radix-tree"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	posSize        = 8
+	posSizeBits    = 22
+	posOffsetBits  = 32
+	posSegmentBits = 64 - posSizeBits - posOffsetBits
+	posMaxSize     = 1<<posSizeBits - 1
+	posMaxOffset   = 1<<posOffsetBits - 1
+	posMaxSegment  = 1<<posSegmentBits - 1
 )
 
 // pos is used to store value postion in value file
-type Pos struct {
-	valPageId uint32
-	valOffset uint32
+// it is packed in 8 bytes
+//
+// +---------+-----------+---------+
+// | segment |  offset   |  size   |
+// | 10 bits |  32 bits  | 22 bits |
+// +---------+-----------+---------+
+//
+// segment is the id of value file, up to 1024 segments,
+// offset is the absolute offset of the value in value file, up to 4GB,
+// so a value is read with one exact size read.
+// a value whose size does not fit in 22 bits is stored with size posMaxSize,
+// its offset is the offset of its entry in the value page header
+type Pos uint64
+
+func NewPos(segment uint32, offset, size uint64) (Pos, error) {
+	if segment > posMaxSegment {
+		return 0, errors.New("value segment overflow")
+	}
+	if offset > posMaxOffset {
+		return 0, errors.New("value offset overflow")
+	}
+	if size > posMaxSize {
+		size = posMaxSize
+	}
+	return Pos(uint64(segment)<<(posOffsetBits+posSizeBits) | offset<<posSizeBits | size), nil
+}
+
+// pos of a value located by the entry or large object at offset
+func NewIndirectPos(segment uint32, offset uint64) (Pos, error) {
+	return NewPos(segment, offset, posMaxSize)
+}
+
+func (p Pos) segment() uint32 {
+	return uint32(uint64(p) >> (posOffsetBits + posSizeBits))
+}
+
+func (p Pos) offset() uint64 {
+	return uint64(p) >> posSizeBits & posMaxOffset
+}
+
+func (p Pos) size() uint64 {
+	return uint64(p) & posMaxSize
 }
 
+// the offset is the value entry in page header or a large object
+func (p Pos) indirect() bool {
+	return p.size() == posMaxSize
+}
+
+// index is only modified by Init,
+// after that Get and GetMany may be called concurrently
+//
+// irs and vrs are the readers of segments, indexed by segment id,
+// dir is the build dir and source identifies its snapshot, see snapshot.go
+// mph replaces index if index type is mph, see mph.go
 type Db struct {
-	ir   *IdxReader
-	vr   *ValReader
-	tree art.Tree
+	cfg    *Config
+	dir    string
+	source uint32
+	irs    []*IdxReader
+	vrs    []*ValReader
+	index  *ShardedIndex
+	mph    *Mph
+	pool   *BufferPool
+	cache  *ValueCache
+	// saves share the tmp file of snapshot and mph
+	saveMu sync.Mutex
+
+	// counters of keys read and failed by kind
+	gets     uint64
+	notFound uint64
+	corrupt  uint64
+	ioErrors uint64
+}
+
+type IndexStats struct {
+	Type   string
+	Shards int
+	Keys   int
+	Memory uint64
+}
+
+type DbStats struct {
+	Gets       uint64
+	NotFound   uint64
+	Corrupt    uint64
+	IOErrors   uint64
+	BufferPool BufferPoolStats
+	ValueCache ValueCacheStats
 }
 
-func NewDb() (*Db, error) {
-	ir, _ := NewIdxReader()
-	vr, _ := NewValReader()
-	tree := art.New()
+// open every segment in the manifest of the current build in store dir
+func NewDb(cfg *Config) (*Db, error) {
+	dir, err := currentBuildDir(cfg.StoreDir)
+	if err != nil {
+		return &Db{}, err
+	}
+	return openDb(cfg, dir)
+}
+
+// open every segment in the manifest of build dir
+func openDb(cfg *Config, dir string) (*Db, error) {
+	m, err := ReadManifest(dir)
+	if err != nil {
+		return &Db{}, err
+	}
+	irs := make([]*IdxReader, len(m.Segments))
+	vrs := make([]*ValReader, len(m.Segments))
+	for id, seg := range m.Segments {
+		if irs[id], err = NewIdxReader(filepath.Join(dir, seg.Idx.Name), uint32(cfg.IdxPageSize)); err != nil {
+			return &Db{}, err
+		}
+		if err := seg.Idx.validate(irs[id].header, fileHeaderSize+irs[id].l); err != nil {
+			return &Db{}, err
+		}
+		if vrs[id], err = NewValReader(filepath.Join(dir, seg.Val.Name), cfg.ValPageSize); err != nil {
+			return &Db{}, err
+		}
+		if err := seg.Val.validate(vrs[id].header, fileHeaderSize+vrs[id].l); err != nil {
+			return &Db{}, err
+		}
+	}
+	index := NewShardedIndex(cfg.IndexType, int(cfg.IndexShards))
+	cache := NewValueCache(cfg.ValueCacheSize)
 
-	return &Db{
-		ir:   ir,
-		vr:   vr,
-		tree: tree,
-	}, nil
+	db := &Db{
+		cfg:    cfg,
+		dir:    dir,
+		source: m.snapshotSource(),
+		irs:    irs,
+		vrs:    vrs,
+		index:  index,
+		cache:  cache,
+	}
+	db.pool = NewBufferPool(cfg.BufferPoolSize, cfg.ValPageSize, db.loadPage)
+	return db, nil
 }
 
 // init db
-// read index file and build adaptive-radix-tree
+// load the mph of build if index type is mph, otherwise
+// load the index from the snapshot of build,
+// a mph or snapshot missing, stale or corrupted is ignored
+// and the index is built from index files
 func (db *Db) Init() error {
 	fmt.Println("building index ...")
 
-	offset := uint32(0)
-	for {
-		keys, valPageIds, valOffsets, err := db.ir.Read(offset)
-		if err != nil {
-			break
-		}
-		for i := 0; i < len(keys); i++ {
-			key := keys[i]
-			valPageId := valPageIds[i]
-			valOffset := valOffsets[i]
-
-			pos := Pos{
-				valPageId: valPageId,
-				valOffset: valOffset,
-			}
-			db.tree.Insert(art.Key(key), art.Value(pos))
-		}
+	if db.cfg.IndexType != indexTypeMph {
+		return db.initIndex()
+	}
+	mph, err := readMph(db.dir, db.source)
+	if err == nil {
+		db.mph = mph
+		fmt.Printf("load mph index success, %d keys\n", mph.Len())
+		return nil
+	}
+	fmt.Printf("mph index not used, %v\n", err)
 
-		offset += defaultIdxPageSize
+	// build mph from index, it is saved for next start,
+	// a build dir not writable is not an error
+	if err := db.initIndex(); err != nil {
+		return err
+	}
+	if db.mph, err = BuildMph(db.index); err != nil {
+		return err
+	}
+	db.index = nil
+	if err := writeMph(db.dir, db.source, db.mph); err != nil {
+		fmt.Println(err)
+	}
+	fmt.Printf("build mph index success, %d keys\n", db.mph.Len())
+	return nil
+}
+
+// load the index from the snapshot or index files
+func (db *Db) initIndex() error {
+	count, err := readSnapshot(db.dir, db.source, db.index)
+	if err == nil {
+		db.index.build()
+		fmt.Printf("load index snapshot success, %d keys\n", count)
+		return nil
+	}
+	fmt.Printf("index snapshot not used, %v\n", err)
+	db.index = NewShardedIndex(db.cfg.IndexType, len(db.index.shards))
+
+	if err := db.loadIndex(); err != nil {
+		return err
 	}
 	fmt.Println("build index success")
 
 	return nil
 }
 
-// first search in tree index
+// save a snapshot of index, or the mph, into the build dir,
+// it replaces the one before, saves are serialized
+func (db *Db) Save() error {
+	db.saveMu.Lock()
+	defer db.saveMu.Unlock()
+	if db.mph != nil {
+		return writeMph(db.dir, db.source, db.mph)
+	}
+	return writeSnapshot(db.dir, db.source, db.index)
+}
+
+// close files of segments
+func (db *Db) Close() {
+	for _, ir := range db.irs {
+		ir.Close()
+	}
+	for _, vr := range db.vrs {
+		vr.Close()
+	}
+}
+
+// value reader of the segment of pos
+func (db *Db) valReader(pos Pos) (*ValReader, error) {
+	if int(pos.segment()) >= len(db.vrs) {
+		return nil, newCorruptError("segment %d of value not found", pos.segment())
+	}
+	return db.vrs[pos.segment()], nil
+}
+
+// id of the value page of pos in buffer pool,
+// the segment id is in the high 32 bits
+func (db *Db) valPageId(pos Pos) uint64 {
+	return uint64(pos.segment())<<32 | pos.offset()/db.cfg.ValPageSize
+}
+
+// load a value page into buffer pool
+func (db *Db) loadPage(valPageId uint64, buf []byte) error {
+	return db.vrs[valPageId>>32].ReadPage(valPageId&(1<<32-1), buf)
+}
+
+// search position of key in index
+func (db *Db) search(key string) (Pos, bool) {
+	if db.mph != nil {
+		return db.mph.Search([]byte(key))
+	}
+	return db.index.Search([]byte(key))
+}
+
+// first search in value cache, then in index
 // if key is exist, we can get a postion
-// then get the value from data file
-// @todo use buffer pool to store recent page
+// then get the value from buffer pool or data file
+//
+// a key not found returns ErrNotFound, a value not matching its checksum
+// returns an ErrCorrupt error, a failed read returns an ErrIO error,
+// use errors.Is to tell them apart
+// the value returned must not be modified
 func (db *Db) Get(key string) ([]byte, error) {
+	atomic.AddUint64(&db.gets, 1)
+	value, err := db.get(key)
+	if err != nil {
+		return nil, db.countError(err)
+	}
+	return value, nil
+}
 
-	posValue, found := db.tree.Search(art.Key(key))
+func (db *Db) get(key string) ([]byte, error) {
+	if value, ok := db.cache.Get(key); ok {
+		return value, nil
+	}
+
+	pos, found := db.search(key)
 	if !found {
-		return nil, errors.New("key not found")
+		return nil, ErrNotFound
+	}
+	if _, err := db.valReader(pos); err != nil {
+		return nil, err
 	}
 
-	pos, ok := posValue.(Pos)
-	if !ok {
-		return nil, errors.New("key not found")
+	values, err := db.readPage(db.valPageId(pos), []Pos{pos})
+	if err != nil {
+		return nil, err
 	}
-	pageOffset := uint64(pos.valPageId * defaultValPageSize)
-	valOffset := uint64(pos.valOffset)
+	db.cache.Add(key, values[0])
+	return values[0], nil
+}
 
-	value, err := db.vr.Read(pageOffset, valOffset)
+// count err by its kind, an error of no kind is taken as ErrIO
+func (db *Db) countError(err error) error {
+	err = ioError(err)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		atomic.AddUint64(&db.notFound, 1)
+	case errors.Is(err, ErrCorrupt):
+		atomic.AddUint64(&db.corrupt, 1)
+	default:
+		atomic.AddUint64(&db.ioErrors, 1)
+	}
+	return err
+}
+
+// get values of many keys
+// keys not in value cache are searched in index and grouped by
+// value page, then every page is read once in ascending page order,
+// the value of a key failed is nil and its error is set as in Get
+func (db *Db) GetMany(keys []string) ([][]byte, []error) {
+	atomic.AddUint64(&db.gets, uint64(len(keys)))
+	values := make([][]byte, len(keys))
+	errs := make([]error, len(keys))
+
+	// indexes of keys in each page
+	pages := make(map[uint64][]int)
+	pageIds := make([]uint64, 0)
+	positions := make([]Pos, len(keys))
+	for i, key := range keys {
+		if value, ok := db.cache.Get(key); ok {
+			values[i] = value
+			continue
+		}
+		pos, found := db.search(key)
+		if !found {
+			errs[i] = db.countError(ErrNotFound)
+			continue
+		}
+		if _, err := db.valReader(pos); err != nil {
+			errs[i] = db.countError(err)
+			continue
+		}
+		positions[i] = pos
+		valPageId := db.valPageId(pos)
+		if _, ok := pages[valPageId]; !ok {
+			pageIds = append(pageIds, valPageId)
+		}
+		pages[valPageId] = append(pages[valPageId], i)
+	}
+	sort.Slice(pageIds, func(i, j int) bool { return pageIds[i] < pageIds[j] })
+
+	for _, valPageId := range pageIds {
+		idxs := pages[valPageId]
+		pagePositions := make([]Pos, len(idxs))
+		for i, idx := range idxs {
+			pagePositions[i] = positions[idx]
+		}
+
+		vals, err := db.readPage(valPageId, pagePositions)
+		if err != nil {
+			for _, idx := range idxs {
+				errs[idx] = db.countError(err)
+			}
+			continue
+		}
+		for i, idx := range idxs {
+			values[idx] = vals[i]
+			db.cache.Add(keys[idx], vals[i])
+		}
+	}
+	return values, errs
+}
+
+// read values in a page from buffer pool or data file
+// a large object is always read from data file, its page is
+// only its header, so it is not worth a frame of pool
+func (db *Db) readPage(valPageId uint64, positions []Pos) ([][]byte, error) {
+	vr := db.vrs[valPageId>>32]
+	if vr.isLarge(positions[0]) {
+		return vr.ReadMany(positions)
+	}
+	frame, err := db.pool.Fetch(valPageId)
+	if errors.Is(err, errLargePage) {
+		return vr.ReadMany(positions)
+	}
 	if err != nil {
-		return nil, errors.New("key not found")
+		return nil, err
+	}
+	if frame == nil {
+		return vr.ReadMany(positions)
+	}
+	defer db.pool.Unpin(frame)
+
+	vals := make([][]byte, len(positions))
+	for i, pos := range positions {
+		if vals[i], err = vr.PageValue(frame.Buf(), pos); err != nil {
+			return nil, err
+		}
+	}
+	return vals, nil
+}
+
+func (db *Db) Stats() DbStats {
+	return DbStats{
+		Gets:       atomic.LoadUint64(&db.gets),
+		NotFound:   atomic.LoadUint64(&db.notFound),
+		Corrupt:    atomic.LoadUint64(&db.corrupt),
+		IOErrors:   atomic.LoadUint64(&db.ioErrors),
+		BufferPool: db.pool.Stats(),
+		ValueCache: db.cache.Stats(),
+	}
+}
+
+// stats of index, it must not be called before Init returns
+func (db *Db) IndexStats() IndexStats {
+	if db.mph != nil {
+		return IndexStats{
+			Type:   indexTypeMph,
+			Shards: 1,
+			Keys:   db.mph.Len(),
+			Memory: db.mph.MemoryUsage(),
+		}
+	}
+	return IndexStats{
+		Type:   db.cfg.IndexType,
+		Shards: len(db.index.shards),
+		Keys:   db.index.Len(),
+		Memory: db.index.MemoryUsage(),
 	}
-	return value, nil
 }
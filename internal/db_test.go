@@ -0,0 +1,318 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+type testRecord struct {
+	key   string
+	value []byte
+}
+
+// records of small values, values larger than a page and a key
+// written twice, the value of a key is the last one written
+func testRecords(n int) []testRecord {
+	recs := make([]testRecord, 0, n+1)
+	for i := 0; i < n; i++ {
+		size := 10 + i%200
+		if i%97 == 0 {
+			size = 3*minValPageSize + i
+		}
+		value := bytes.Repeat([]byte{byte('a' + i%26)}, size)
+		copy(value, fmt.Sprintf("value-%d-", i))
+		recs = append(recs, testRecord{key: fmt.Sprintf("key-%d", i), value: value})
+	}
+	recs = append(recs, testRecord{key: "key-1", value: []byte("value-1-last")})
+	return recs
+}
+
+// config of a store in a tmp dir with small pages and segments,
+// so the records of a test span many pages and segments
+func testConfig(t *testing.T) *Config {
+	dir := t.TempDir()
+	cfg := DefaultConfig()
+	cfg.DataPath = filepath.Join(dir, "org.data")
+	cfg.StoreDir = filepath.Join(dir, "store")
+	cfg.IdxPageSize = minIdxPageSize
+	cfg.ValPageSize = minValPageSize
+	cfg.SegmentSize = 16 * minValPageSize
+	cfg.BufferPoolSize = 8 * minValPageSize
+	cfg.ValueCacheSize = 16 * 1024
+	cfg.IndexShards = 4
+	return cfg
+}
+
+// write records into the data file of cfg and build the store
+func buildTestStore(t *testing.T, cfg *Config, recs []testRecord) {
+	var buf bytes.Buffer
+	for _, rec := range recs {
+		binary.Write(&buf, binary.BigEndian, uint32(len(rec.key)))
+		buf.WriteString(rec.key)
+		binary.Write(&buf, binary.BigEndian, uint64(len(rec.value)))
+		buf.Write(rec.value)
+	}
+	if err := ioutil.WriteFile(cfg.DataPath, buf.Bytes(), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(cfg.StoreDir, 0750); err != nil {
+		t.Fatal(err)
+	}
+	idxer, err := NewIndexer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := idxer.Run(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// build a store of records and open it
+func openTestDb(t *testing.T, cfg *Config, recs []testRecord) *Db {
+	buildTestStore(t, cfg, recs)
+	db, err := NewDb(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+	if err := db.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// the last value of every key
+func testValues(recs []testRecord) map[string][]byte {
+	values := make(map[string][]byte)
+	for _, rec := range recs {
+		values[rec.key] = rec.value
+	}
+	return values
+}
+
+func TestDbGetConcurrent(t *testing.T) {
+	for _, pool := range []uint64{0, 8 * minValPageSize} {
+		t.Run(fmt.Sprintf("pool-%d", pool), func(t *testing.T) {
+			cfg := testConfig(t)
+			cfg.BufferPoolSize = pool
+			recs := testRecords(1000)
+			db := openTestDb(t, cfg, recs)
+			values := testValues(recs)
+			keys := make([]string, 0, len(values))
+			for key := range values {
+				keys = append(keys, key)
+			}
+
+			var wg sync.WaitGroup
+			for g := 0; g < 16; g++ {
+				wg.Add(1)
+				go func(g int) {
+					defer wg.Done()
+					for i := 0; i < 500; i++ {
+						key := keys[(g*131+i*17)%len(keys)]
+						value, err := db.Get(key)
+						if err != nil || !bytes.Equal(value, values[key]) {
+							t.Errorf("Get(%s) = %.20q, %v", key, value, err)
+							return
+						}
+						if _, err := db.Get(key + "-missing"); !errors.Is(err, ErrNotFound) {
+							t.Errorf("Get(%s-missing) error %v, want ErrNotFound", key, err)
+							return
+						}
+
+						batch := []string{key, keys[(g+i)%len(keys)], "missing", key}
+						vals, errs := db.GetMany(batch)
+						for j, k := range batch {
+							if k == "missing" {
+								if !errors.Is(errs[j], ErrNotFound) {
+									t.Errorf("GetMany missing error %v, want ErrNotFound", errs[j])
+								}
+								continue
+							}
+							if errs[j] != nil || !bytes.Equal(vals[j], values[k]) {
+								t.Errorf("GetMany %s = %.20q, %v", k, vals[j], errs[j])
+								return
+							}
+						}
+					}
+				}(g)
+			}
+			wg.Wait()
+		})
+	}
+}
+
+// values read together are copied out of the read,
+// so a value in cache holds no more than its own bytes
+//
+// values of a shared read are next to each other in the buffer,
+// with only a checksum between them
+func TestDbGetManyOwnValues(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.BufferPoolSize = 0
+	recs := testRecords(100)
+	db := openTestDb(t, cfg, recs)
+
+	keys := make([]string, 0, 50)
+	for i := 2; i < 52; i++ {
+		keys = append(keys, fmt.Sprintf("key-%d", i))
+	}
+	values, errs := db.GetMany(keys)
+	shared := 0
+	for i, value := range values {
+		if errs[i] != nil {
+			t.Fatalf("GetMany %s: %v", keys[i], errs[i])
+		}
+		if i == 0 {
+			continue
+		}
+		if adjacent(values[i-1], value) || adjacent(value, values[i-1]) {
+			shared++
+		}
+	}
+	if shared > len(values)/2 {
+		t.Errorf("%d of %d values share a read buffer", shared, len(values))
+	}
+}
+
+// whether b starts at the checksum right after a
+func adjacent(a, b []byte) bool {
+	return uintptr(unsafe.Pointer(&b[0])) == uintptr(unsafe.Pointer(&a[0]))+uintptr(len(a)+checksumSize)
+}
+
+func TestPos(t *testing.T) {
+	cases := []struct {
+		segment      uint32
+		offset, size uint64
+	}{
+		{0, 0, 0},
+		{1, 4096, 100},
+		{posMaxSegment, posMaxOffset, posMaxSize - 1},
+		{posMaxSegment, posMaxOffset - 4095, posMaxSize},
+	}
+	for _, c := range cases {
+		pos, err := NewPos(c.segment, c.offset, c.size)
+		if err != nil {
+			t.Fatalf("NewPos(%d, %d, %d): %v", c.segment, c.offset, c.size, err)
+		}
+		if pos.segment() != c.segment || pos.offset() != c.offset || pos.size() != c.size {
+			t.Errorf("NewPos(%d, %d, %d) = %d, %d, %d", c.segment, c.offset, c.size, pos.segment(), pos.offset(), pos.size())
+		}
+		if pos.indirect() != (c.size == posMaxSize) {
+			t.Errorf("NewPos(%d, %d, %d) indirect %v", c.segment, c.offset, c.size, pos.indirect())
+		}
+	}
+
+	// a value too large for pos is indirect
+	pos, err := NewPos(posMaxSegment, posMaxOffset, 1<<32)
+	if err != nil || !pos.indirect() || pos.offset() != posMaxOffset || pos.segment() != posMaxSegment {
+		t.Errorf("NewPos of large value = %x, %v", uint64(pos), err)
+	}
+	if _, err := NewPos(posMaxSegment+1, 0, 1); err == nil {
+		t.Error("NewPos of segment overflow succeeded")
+	}
+	if _, err := NewPos(0, posMaxOffset+1, 1); err == nil {
+		t.Error("NewPos of offset overflow succeeded")
+	}
+}
+
+// saves at once leave a whole snapshot and mph
+func TestDbSaveConcurrent(t *testing.T) {
+	for _, indexType := range []string{indexTypeArt, indexTypeMph} {
+		t.Run(indexType, func(t *testing.T) {
+			cfg := testConfig(t)
+			cfg.IndexType = indexType
+			recs := testRecords(1000)
+			db := openTestDb(t, cfg, recs)
+
+			var wg sync.WaitGroup
+			for g := 0; g < 8; g++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if err := db.Save(); err != nil {
+						t.Error(err)
+					}
+				}()
+			}
+			wg.Wait()
+
+			if indexType == indexTypeMph {
+				if _, err := readMph(db.dir, db.source); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			index := NewShardedIndex(indexTypeArt, 4)
+			count, err := readSnapshot(db.dir, db.source, index)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := len(testValues(recs)); count != uint64(want) {
+				t.Errorf("snapshot has %d keys, want %d", count, want)
+			}
+		})
+	}
+}
+
+// a sorted index is sorted by loading, not by the first search
+func TestDbSortedIndexBuilt(t *testing.T) {
+	for _, snapshot := range []bool{true, false} {
+		t.Run(fmt.Sprintf("snapshot-%v", snapshot), func(t *testing.T) {
+			cfg := testConfig(t)
+			cfg.IndexType = indexTypeSorted
+			buildTestStore(t, cfg, testRecords(1000))
+			db, err := NewDb(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			if !snapshot {
+				os.Remove(filepath.Join(db.dir, snapshotFile))
+			}
+			if err := db.Init(); err != nil {
+				t.Fatal(err)
+			}
+			for i, shard := range db.index.shards {
+				if shard.(*sortedIndex).sorted != 1 {
+					t.Errorf("shard %d not sorted after loading", i)
+				}
+			}
+		})
+	}
+}
+
+// a large object is read from disk, it never takes a page of pool
+func TestDbLargeValueBypassesPool(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.BufferPoolSize = minValPageSize
+	cfg.ValueCacheSize = 0
+	recs := testRecords(100)
+	db := openTestDb(t, cfg, recs)
+	values := testValues(recs)
+
+	// key-0 is a large object, key-2 is in a page
+	for _, key := range []string{"key-2", "key-2", "key-0", "key-0", "key-0"} {
+		value, err := db.Get(key)
+		if err != nil || !bytes.Equal(value, values[key]) {
+			t.Fatalf("Get(%s) = %.20q, %v", key, value, err)
+		}
+	}
+	values2, errs := db.GetMany([]string{"key-0", "key-0"})
+	if errs[0] != nil || !bytes.Equal(values2[0], values["key-0"]) {
+		t.Fatalf("GetMany(key-0) = %.20q, %v", values2[0], errs[0])
+	}
+	stats := db.Stats().BufferPool
+	if stats.Admits != 1 || stats.Evicts != 0 || stats.Pages != 1 {
+		t.Errorf("pool admits %d, evicts %d, pages %d, want the page of key-2 only", stats.Admits, stats.Evicts, stats.Pages)
+	}
+}
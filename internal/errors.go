@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// kinds of errors, use errors.Is to check the kind of an error
+var (
+	ErrNotFound = errors.New("not found")
+	ErrCorrupt  = errors.New("data corrupted")
+	ErrIO       = errors.New("I/O error")
+	ErrConfig   = errors.New("config error")
+)
+
+// exit codes of commands, see ExitCode
+const (
+	exitFailure  = 1
+	exitConfig   = 2
+	exitNotFound = 3
+	exitCorrupt  = 4
+	exitIO       = 5
+)
+
+// an error of kind, err is the cause and may be nil
+type kindError struct {
+	kind error
+	msg  string
+	err  error
+}
+
+func (e *kindError) Error() string {
+	s := e.kind.Error()
+	if e.msg != "" {
+		s += ": " + e.msg
+	}
+	if e.err != nil {
+		s += ": " + e.err.Error()
+	}
+	return s
+}
+
+func (e *kindError) Is(target error) bool {
+	return target == e.kind
+}
+
+func (e *kindError) Unwrap() error {
+	return e.err
+}
+
+func newCorruptError(format string, args ...interface{}) error {
+	return &kindError{kind: ErrCorrupt, msg: fmt.Sprintf(format, args...)}
+}
+
+func newConfigError(format string, args ...interface{}) error {
+	return &kindError{kind: ErrConfig, msg: fmt.Sprintf(format, args...)}
+}
+
+// whether err is already of a kind, either a kindError
+// or a sentinel such as ErrNotFound returned as is
+func hasKind(err error) bool {
+	var ke *kindError
+	return errors.As(err, &ke) || errors.Is(err, ErrNotFound) || errors.Is(err, ErrCorrupt) ||
+		errors.Is(err, ErrIO) || errors.Is(err, ErrConfig)
+}
+
+// mark err of reading or writing files as ErrIO,
+// a file not exists is ErrNotFound, an error of a kind is kept
+func ioError(err error) error {
+	if err == nil || hasKind(err) {
+		return err
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return &kindError{kind: ErrNotFound, err: err}
+	}
+	return &kindError{kind: ErrIO, err: err}
+}
+
+// mark err of loading config as ErrConfig
+func configError(err error) error {
+	if err == nil || hasKind(err) {
+		return err
+	}
+	return &kindError{kind: ErrConfig, err: err}
+}
+
+// exit code of a command failed with err
+//
+//	1 other errors
+//	2 invalid config, or the store does not match config
+//	3 store not found
+//	4 store corrupted
+//	5 I/O error
+func ExitCode(err error) int {
+	switch {
+	case errors.Is(err, ErrConfig):
+		return exitConfig
+	case errors.Is(err, ErrNotFound):
+		return exitNotFound
+	case errors.Is(err, ErrCorrupt):
+		return exitCorrupt
+	case errors.Is(err, ErrIO):
+		return exitIO
+	}
+	return exitFailure
+}
@@ -0,0 +1,39 @@
+package internal
+
+import (
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestErrorKinds(t *testing.T) {
+	kinds := []error{ErrNotFound, ErrCorrupt, ErrIO, ErrConfig}
+	cases := []struct {
+		err  error
+		kind error
+	}{
+		{ErrNotFound, ErrNotFound},
+		{errors.Wrap(ErrNotFound, "key"), ErrNotFound},
+		{ErrCorrupt, ErrCorrupt},
+		{newCorruptError("bad page"), ErrCorrupt},
+		{newConfigError("bad size"), ErrConfig},
+		{errors.Wrap(os.ErrNotExist, "open"), ErrNotFound},
+		{errors.New("disk failed"), ErrIO},
+	}
+	for _, c := range cases {
+		for _, err := range []error{ioError(c.err), (&Db{}).countError(c.err)} {
+			for _, kind := range kinds {
+				if got := errors.Is(err, kind); got != (kind == c.kind) {
+					t.Errorf("errors.Is(%q, %v) = %v", err, kind, got)
+				}
+			}
+		}
+	}
+	if err := ioError(ErrNotFound); err != ErrNotFound {
+		t.Errorf("ioError(ErrNotFound) = %q, want it unchanged", err)
+	}
+	if err := configError(ErrCorrupt); err != ErrCorrupt {
+		t.Errorf("configError(ErrCorrupt) = %q, want it unchanged", err)
+	}
+}
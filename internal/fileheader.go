@@ -0,0 +1,151 @@
+package internal
+
+import (
+	"encoding/binary"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/exp/mmap"
+)
+
+const (
+	fileHeaderSize    = 4 * 1024
+	fileFormatVersion = 2
+	fileByteOrderMark = 0x01020304
+	fileCreatorSize   = 64
+	fileHeaderUsed    = 4*3 + 8*4 + fileCreatorSize + checksumSize
+)
+
+var (
+	idxFileMagic = [4]byte{'I', 'K', 'V', 'I'}
+	valFileMagic = [4]byte{'I', 'K', 'V', 'V'}
+)
+
+// header at the start of index and value files
+// it is padded with zeros to fileHeaderSize, pages start after it.
+// offsets in Pos and in index are relative to the end of header
+//
+// the header is written as zeros when a file is created and filled
+// when the writer is closed, so a file not completely built is rejected
+//
+// byteOrder is fileByteOrderMark in the byte order of the file,
+// createdAt is unix nano, creator is the host name of the indexer,
+// checksum is the crc32c of the header before it
+//
+// +---------+---------+-----------+----------+-----------+
+// |  magic  | version | byteOrder | pageSize | pageCount |
+// | [4]byte | uint32  |  uint32   |  uint64  |  uint64   |
+// +---------+---------+-----------+----------+-----------+
+// +-------------+-----------+----------+----------+---------+
+// | recordCount | createdAt | creator  | checksum | padding |
+// |   uint64    |   int64   | [64]byte |  uint32  |         |
+// +-------------+-----------+----------+----------+---------+
+type FileHeader struct {
+	Magic       [4]byte
+	Version     uint32
+	PageSize    uint64
+	PageCount   uint64
+	RecordCount uint64
+	CreatedAt   int64
+	Creator     string
+}
+
+func newFileHeader(magic [4]byte, pageSize uint64) *FileHeader {
+	creator, _ := os.Hostname()
+	if len(creator) > fileCreatorSize {
+		creator = creator[0:fileCreatorSize]
+	}
+	return &FileHeader{
+		Magic:     magic,
+		Version:   fileFormatVersion,
+		PageSize:  pageSize,
+		CreatedAt: time.Now().UnixNano(),
+		Creator:   creator,
+	}
+}
+
+// encode header to disk format, padded to fileHeaderSize
+func (h *FileHeader) encode() []byte {
+	buf := make([]byte, fileHeaderSize)
+	copy(buf[0:4], h.Magic[:])
+	binary.BigEndian.PutUint32(buf[4:], h.Version)
+	binary.BigEndian.PutUint32(buf[8:], fileByteOrderMark)
+	binary.BigEndian.PutUint64(buf[12:], h.PageSize)
+	binary.BigEndian.PutUint64(buf[20:], h.PageCount)
+	binary.BigEndian.PutUint64(buf[28:], h.RecordCount)
+	binary.BigEndian.PutUint64(buf[36:], uint64(h.CreatedAt))
+	copy(buf[44:44+fileCreatorSize], h.Creator)
+	end := fileHeaderUsed - checksumSize
+	binary.BigEndian.PutUint32(buf[end:], checksum(buf[0:end]))
+	return buf
+}
+
+// decode header from buf, which holds at least fileHeaderUsed bytes
+func decodeFileHeader(buf []byte) (*FileHeader, error) {
+	h := &FileHeader{}
+	copy(h.Magic[:], buf[0:4])
+	if h.Magic != idxFileMagic && h.Magic != valFileMagic {
+		return nil, newCorruptError("bad magic, not an ikv file or not completely built")
+	}
+	end := fileHeaderUsed - checksumSize
+	if err := verifyChecksum(buf[0:end], buf[end:fileHeaderUsed], "file header", 0); err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint32(buf[8:]) != fileByteOrderMark {
+		return nil, newCorruptError("unsupported byte order")
+	}
+	h.Version = binary.BigEndian.Uint32(buf[4:])
+	h.PageSize = binary.BigEndian.Uint64(buf[12:])
+	h.PageCount = binary.BigEndian.Uint64(buf[20:])
+	h.RecordCount = binary.BigEndian.Uint64(buf[28:])
+	h.CreatedAt = int64(binary.BigEndian.Uint64(buf[36:]))
+	creator := buf[44 : 44+fileCreatorSize]
+	for i, c := range creator {
+		if c == 0 {
+			creator = creator[0:i]
+			break
+		}
+	}
+	h.Creator = string(creator)
+	return h, nil
+}
+
+// check the header is compatible with the reader
+// size is the size of file without header
+func (h *FileHeader) validate(magic [4]byte, pageSize, size uint64) error {
+	if h.Magic != magic {
+		return newCorruptError("unexpected file type '%s', expected '%s'", h.Magic[:], magic[:])
+	}
+	if h.Version != fileFormatVersion {
+		return newConfigError("unsupported format version %d, expected %d", h.Version, fileFormatVersion)
+	}
+	if h.PageSize != pageSize {
+		return newConfigError("page size %d, expected %d", h.PageSize, pageSize)
+	}
+	if h.PageCount*h.PageSize != size {
+		return newCorruptError("%d pages of size %d, but file has %d bytes of pages", h.PageCount, h.PageSize, size)
+	}
+	return nil
+}
+
+// read and validate the header of file at path opened by r
+// return the header and the size of file without header
+func readFileHeader(r *mmap.ReaderAt, path string, magic [4]byte, pageSize uint64) (*FileHeader, uint64, error) {
+	if r.Len() < fileHeaderSize {
+		return nil, 0, newCorruptError("file %s too small for file header", path)
+	}
+	buf := make([]byte, fileHeaderUsed)
+	if _, err := r.ReadAt(buf, 0); err != nil {
+		return nil, 0, ioError(errors.Wrapf(err, "failed reading file header of %s", path))
+	}
+	h, err := decodeFileHeader(buf)
+	if err != nil {
+		return nil, 0, errors.Wrapf(err, "incompatible file %s", path)
+	}
+	size := uint64(r.Len() - fileHeaderSize)
+	if err := h.validate(magic, pageSize, size); err != nil {
+		return nil, 0, errors.Wrapf(err, "incompatible file %s", path)
+	}
+	return h, size, nil
+}
@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"bytes"
+	"unsafe"
+)
+
+const (
+	hashIndexInitSlots = 1024
+	// the table grows when it is more than 3/4 full
+	hashIndexLoadNum = 3
+	hashIndexLoadDen = 4
+)
+
+// slot of hash index, fp is the fingerprint of key, 0 is an empty slot
+// off is the offset of key in arena
+type hashSlot struct {
+	fp  uint64
+	off uint64
+	pos Pos
+}
+
+// open-addressing hash table of key fingerprints with linear probing
+// keys are compared by fingerprint first, the key in arena is only
+// compared when fingerprints match, keys are iterated in no order
+type hashIndex struct {
+	slots []hashSlot
+	mask  uint64
+	n     int
+	arena keyArena
+}
+
+func newHashIndex() *hashIndex {
+	return &hashIndex{
+		slots: make([]hashSlot, hashIndexInitSlots),
+		mask:  hashIndexInitSlots - 1,
+	}
+}
+
+// fingerprint of key by fnv-1a, never 0
+func keyFingerprint(key []byte) uint64 {
+	h := uint64(14695981039346656037)
+	for _, c := range key {
+		h ^= uint64(c)
+		h *= 1099511628211
+	}
+	if h == 0 {
+		h = 1
+	}
+	return h
+}
+
+// slot of key, or the empty slot it would be inserted into
+func (x *hashIndex) find(key []byte, fp uint64) *hashSlot {
+	for i := fp & x.mask; ; i = (i + 1) & x.mask {
+		s := &x.slots[i]
+		if s.fp == 0 || (s.fp == fp && bytes.Equal(x.arena.key(s.off), key)) {
+			return s
+		}
+	}
+}
+
+func (x *hashIndex) Insert(key []byte, pos Pos) {
+	if (x.n+1)*hashIndexLoadDen > len(x.slots)*hashIndexLoadNum {
+		x.grow()
+	}
+	fp := keyFingerprint(key)
+	s := x.find(key, fp)
+	if s.fp == 0 {
+		s.fp = fp
+		s.off = x.arena.add(key)
+		x.n++
+	}
+	s.pos = pos
+}
+
+// double the table, keys in arena are not moved
+func (x *hashIndex) grow() {
+	slots := x.slots
+	x.slots = make([]hashSlot, len(slots)*2)
+	x.mask = uint64(len(x.slots) - 1)
+	for _, s := range slots {
+		if s.fp == 0 {
+			continue
+		}
+		i := s.fp & x.mask
+		for x.slots[i].fp != 0 {
+			i = (i + 1) & x.mask
+		}
+		x.slots[i] = s
+	}
+}
+
+func (x *hashIndex) Search(key []byte) (Pos, bool) {
+	s := x.find(key, keyFingerprint(key))
+	if s.fp == 0 {
+		return 0, false
+	}
+	return s.pos, true
+}
+
+func (x *hashIndex) Iterate(fn func(key []byte, pos Pos) bool) {
+	for _, s := range x.slots {
+		if s.fp != 0 && !fn(x.arena.key(s.off), s.pos) {
+			return
+		}
+	}
+}
+
+func (x *hashIndex) Len() int {
+	return x.n
+}
+
+func (x *hashIndex) MemoryUsage() uint64 {
+	return uint64(len(x.slots))*uint64(unsafe.Sizeof(hashSlot{})) + x.arena.size()
+}
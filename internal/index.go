@@ -0,0 +1,122 @@
+package internal
+
+import (
+	"encoding/binary"
+
+	art "github.com/plar/go-adaptive-radix-tree"
+)
+
+const (
+	indexTypeArt    = "art"
+	indexTypeHash   = "hash"
+	indexTypeSorted = "sorted"
+	indexTypeMph    = "mph"
+
+	defaultIndexType = indexTypeArt
+
+	// estimated memory of a key in art besides the key itself,
+	// a leaf, the value and the share of inner nodes
+	artKeyOverhead = 96
+)
+
+// in-memory index of keys to their positions
+// an index is not safe for concurrent modification,
+// after building, Search, Iterate and Len may be called concurrently
+//
+// a key inserted again takes the position inserted last
+type Index interface {
+	Insert(key []byte, pos Pos)
+	Search(key []byte) (Pos, bool)
+	// call fn on every key until it returns false,
+	// the key passed to fn must not be modified
+	Iterate(fn func(key []byte, pos Pos) bool)
+	// number of keys
+	Len() int
+	// bytes of memory used, estimated for art
+	MemoryUsage() uint64
+}
+
+func validIndexType(t string) bool {
+	return t == indexTypeArt || t == indexTypeHash || t == indexTypeSorted || t == indexTypeMph
+}
+
+// new index of type t, see Config.IndexType
+// mph is built from art, see Db.Init
+func NewIndex(t string) Index {
+	switch t {
+	case indexTypeHash:
+		return newHashIndex()
+	case indexTypeSorted:
+		return newSortedIndex()
+	}
+	return newArtIndex()
+}
+
+// adaptive-radix-tree, keys are iterated in order
+type artIndex struct {
+	tree     art.Tree
+	keyBytes uint64
+}
+
+func newArtIndex() *artIndex {
+	return &artIndex{tree: art.New()}
+}
+
+func (x *artIndex) Insert(key []byte, pos Pos) {
+	if _, updated := x.tree.Insert(art.Key(key), art.Value(pos)); !updated {
+		x.keyBytes += uint64(len(key))
+	}
+}
+
+func (x *artIndex) Search(key []byte) (Pos, bool) {
+	value, found := x.tree.Search(art.Key(key))
+	if !found {
+		return 0, false
+	}
+	pos, ok := value.(Pos)
+	return pos, ok
+}
+
+// false returned by a callback of ForEach only skips the children
+// of the node, so fn is not called again once it returns false
+func (x *artIndex) Iterate(fn func(key []byte, pos Pos) bool) {
+	stop := false
+	x.tree.ForEach(func(node art.Node) bool {
+		if !stop {
+			stop = !fn(node.Key(), node.Value().(Pos))
+		}
+		return !stop
+	})
+}
+
+func (x *artIndex) Len() int {
+	return x.tree.Size()
+}
+
+func (x *artIndex) MemoryUsage() uint64 {
+	return x.keyBytes + uint64(x.tree.Size())*artKeyOverhead
+}
+
+// keys of hash and sorted index are kept in an arena,
+// a key is its size followed by its bytes, referred by offset
+type keyArena struct {
+	buf []byte
+}
+
+func (a *keyArena) add(key []byte) uint64 {
+	off := uint64(len(a.buf))
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(key)))
+	a.buf = append(a.buf, size[:]...)
+	a.buf = append(a.buf, key...)
+	return off
+}
+
+func (a *keyArena) key(off uint64) []byte {
+	size := uint64(binary.BigEndian.Uint32(a.buf[off:]))
+	return a.buf[off+4 : off+4+size : off+4+size]
+}
+
+func (a *keyArena) size() uint64 {
+	return uint64(cap(a.buf))
+}
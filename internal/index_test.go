@@ -0,0 +1,77 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestIndex(t *testing.T) {
+	const n = 2000
+	for _, indexType := range []string{indexTypeArt, indexTypeHash, indexTypeSorted} {
+		t.Run(indexType, func(t *testing.T) {
+			index := NewIndex(indexType)
+			want := make(map[string]Pos)
+			for i := 0; i < n; i++ {
+				key := fmt.Sprintf("key-%d", i)
+				index.Insert([]byte(key), Pos(i))
+				want[key] = Pos(i)
+			}
+			// a key inserted again takes the last position
+			for i := 0; i < n; i += 7 {
+				key := fmt.Sprintf("key-%d", i)
+				index.Insert([]byte(key), Pos(n+i))
+				want[key] = Pos(n + i)
+			}
+
+			// a fresh index is searched in parallel
+			var wg sync.WaitGroup
+			for g := 0; g < 8; g++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for key, pos := range want {
+						if got, ok := index.Search([]byte(key)); !ok || got != pos {
+							t.Errorf("Search(%s) = %d, %v, want %d", key, got, ok, pos)
+							return
+						}
+					}
+					if pos, ok := index.Search([]byte("missing")); ok {
+						t.Errorf("Search(missing) = %d, want not found", pos)
+					}
+				}()
+			}
+			wg.Wait()
+
+			if index.Len() != len(want) {
+				t.Errorf("Len() = %d, want %d", index.Len(), len(want))
+			}
+			seen := make(map[string]bool)
+			var last []byte
+			index.Iterate(func(key []byte, pos Pos) bool {
+				if seen[string(key)] || want[string(key)] != pos {
+					t.Errorf("Iterate %s at %d, want once at %d", key, pos, want[string(key)])
+				}
+				if indexType != indexTypeHash && last != nil && bytes.Compare(last, key) >= 0 {
+					t.Errorf("Iterate %s after %s, want in order", key, last)
+				}
+				seen[string(key)] = true
+				last = append(last[:0], key...)
+				return true
+			})
+			if len(seen) != len(want) {
+				t.Errorf("Iterate %d keys, want %d", len(seen), len(want))
+			}
+
+			stopped := 0
+			index.Iterate(func(key []byte, pos Pos) bool {
+				stopped++
+				return stopped < 10
+			})
+			if stopped != 10 {
+				t.Errorf("Iterate called %d times after stop, want 10", stopped)
+			}
+		})
+	}
+}
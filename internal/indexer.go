@@ -2,67 +2,252 @@ package internal
 
 import (
 	"fmt"
+	"io"
+	"os"
 )
 
 type Indexer struct {
-	r *DataStreamReader
+	cfg *Config
+	r   *DataStreamReader
 }
 
-func NewIndexer() *Indexer {
-	r, _ := NewDataStreamReader()
-	return &Indexer{
-		r: r,
+func NewIndexer(cfg *Config) (*Indexer, error) {
+	r, err := NewDataStreamReader(cfg.DataPath, uint32(cfg.MaxKeySize))
+	if err != nil {
+		return &Indexer{}, ioError(err)
 	}
+	return &Indexer{
+		cfg: cfg,
+		r:   r,
+	}, nil
 }
 
 // read original data file
-// build index file and value file
-func (idxer *Indexer) Run() {
+// build index files and value files of segments in store dir
+//
+// the store is locked while building, the new build is written into
+// a tmp dir and replaces the current build only when it is complete,
+// see store.go
+func (idxer *Indexer) Run() error {
 	fmt.Println("building index ...")
-	valPageId := uint32(0)
-	valOffset := uint32(0)
+	dir := idxer.cfg.StoreDir
+
+	lock, err := LockStore(dir)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	tmp, err := newBuildDir(dir)
+	if err != nil {
+		return err
+	}
+	segments, err := idxer.build(tmp)
+	if err == nil {
+		err = commitBuildDir(dir, tmp)
+	}
+	if err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	fmt.Printf("build index success, %d segments\n", segments)
+	return nil
+}
+
+// build segments into dir, return the number of segments
+// the manifest is written after all segments
+func (idxer *Indexer) build(dir string) (uint32, error) {
+	valPageId := uint64(0)
+
+	segmentSize := idxer.cfg.SegmentSize
+	valPageSize := idxer.cfg.ValPageSize
+	idxPageSize := uint32(idxer.cfg.IdxPageSize)
 
-	valPage, _ := NewValPage(defaultValPageSize)
-	idxPage, _ := NewIdxPage(defaultIdxPageSize)
+	valPage, _ := NewValPage(valPageSize)
+	idxPage, _ := NewIdxPage(idxPageSize)
 
-	valPageWriter, _ := NewValPageWriter(valFilePath)
-	idxPageWriter, _ := NewIdxPageWriter(idxFilePath)
+	manifest := NewManifest(uint64(idxPageSize), valPageSize)
+	seg, err := NewSegmentWriter(dir, 0, idxPageSize, valPageSize)
+	if err != nil {
+		return 0, err
+	}
+
+	// whether n more pages from valPageId on exceed the segment,
+	// a segment has at least one page or large object
+	full := func(n uint64) bool {
+		return valPageId > 0 && (valPageId+n)*valPageSize > segmentSize
+	}
+	// the value page is written, write the index page to current segment
+	// and go on with the next segment
+	roll := func() error {
+		if !idxPage.Empty() {
+			if _, _, err := seg.iw.Write(idxPage); err != nil {
+				return err
+			}
+			idxPage, _ = NewIdxPage(idxPageSize)
+		}
+		if err := seg.Close(); err != nil {
+			return err
+		}
+		manifest.addSegment(seg)
+		next, err := NewSegmentWriter(dir, seg.id+1, idxPageSize, valPageSize)
+		if err != nil {
+			return err
+		}
+		seg = next
+		valPageId = 0
+		return nil
+	}
 
 	for {
 		keySize, err := idxer.r.ReadKeySize()
-		if err != nil {
-			_, _, _ = valPageWriter.Write(valPage)
-			_, _, _ = idxPageWriter.Write(idxPage)
+		if err == io.EOF {
 			break
 		}
-		key, _ := idxer.r.ReadKey(keySize)
-		valSize, _ := idxer.r.ReadValueSize()
-		//offset := idxer.r.GetOffset()
-		value, _ := idxer.r.ReadValue(valSize)
-
-		// write value page
-		err = valPage.Append(valSize, value)
 		if err != nil {
-			_, _, _ = valPageWriter.Write(valPage)
-			// current page is full, add a new one
-			valPage, _ = NewValPage(defaultValPageSize)
-			// @todo
-			_ = valPage.Append(valSize, value)
-			valPageId++
-			valOffset = uint32(0)
+			return 0, err
+		}
+		key, err := idxer.r.ReadKey(keySize)
+		if err != nil {
+			return 0, err
+		}
+		valSize, err := idxer.r.ReadValueSize()
+		if err != nil {
+			return 0, err
+		}
+
+		var pos Pos
+		if !valPage.Fits(valSize) {
+			// value is too large for a page, write it as a large object
+			// after the current page, and go on with a new page after it
+			if !valPage.Empty() {
+				if _, _, err := seg.vw.Write(valPage); err != nil {
+					return 0, err
+				}
+				valPage, _ = NewValPage(valPageSize)
+				valPageId++
+			}
+			if full(valLargePages(valSize, valPageSize)) {
+				if err := roll(); err != nil {
+					return 0, err
+				}
+			}
+			pos, err = NewIndirectPos(seg.id, valPageId*valPageSize)
+			if err != nil {
+				return 0, err
+			}
+			_, _, err = seg.vw.WriteLarge(valSize, valPageSize, idxer.r.ValueReader(valSize))
+			if err != nil {
+				return 0, err
+			}
+			valPageId += valLargePages(valSize, valPageSize)
 		} else {
-			valOffset++
+			// the page after a large object may be past the segment
+			if valPage.Empty() && full(1) {
+				if err := roll(); err != nil {
+					return 0, err
+				}
+			}
+			value, err := idxer.r.ReadValue(valSize)
+			if err != nil {
+				return 0, err
+			}
+
+			// write value page
+			valOffset, err := valPage.Append(valSize, value)
+			if err != nil {
+				if _, _, err := seg.vw.Write(valPage); err != nil {
+					return 0, err
+				}
+				// current page is full, add a new one
+				valPage, _ = NewValPage(valPageSize)
+				valPageId++
+				if full(1) {
+					if err := roll(); err != nil {
+						return 0, err
+					}
+				}
+				valOffset, _ = valPage.Append(valSize, value)
+			}
+
+			// value too large for pos is located by its entry in page header
+			pageOffset := valPageId * valPageSize
+			if valSize < posMaxSize {
+				pos, err = NewPos(seg.id, pageOffset+valOffset, valSize)
+			} else {
+				pos, err = NewIndirectPos(seg.id, pageOffset+valEntryOffset(valPage.count-1))
+			}
+			if err != nil {
+				return 0, err
+			}
 		}
 
 		// write index page
-		err = idxPage.Append(keySize, valPageId, valOffset, key)
+		if !idxPage.Fits(keySize) {
+			// key is too large for a page, write it as a large key
+			// after the current page, and go on with a new page after it
+			if !idxPage.Empty() {
+				if _, _, err := seg.iw.Write(idxPage); err != nil {
+					return 0, err
+				}
+				idxPage, _ = NewIdxPage(idxPageSize)
+			}
+			if _, _, err = seg.iw.WriteLarge(keySize, idxPageSize, pos, key); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		err = idxPage.Append(keySize, pos, key)
 		if err != nil {
-			_, _, _ = idxPageWriter.Write(idxPage)
+			if _, _, err := seg.iw.Write(idxPage); err != nil {
+				return 0, err
+			}
 			// current page is full, add a new one
-			idxPage, _ = NewIdxPage(defaultIdxPageSize)
-			// @todo
-			_ = idxPage.Append(keySize, valPageId, valOffset, key)
+			idxPage, _ = NewIdxPage(idxPageSize)
+			_ = idxPage.Append(keySize, pos, key)
+		}
+	}
+	// a page left empty after a large object is not written,
+	// it may be past the segment
+	if !valPage.Empty() || valPageId == 0 {
+		if _, _, err := seg.vw.Write(valPage); err != nil {
+			return 0, err
 		}
 	}
-	fmt.Println("build index success")
+	if _, _, err := seg.iw.Write(idxPage); err != nil {
+		return 0, err
+	}
+	// the headers are written at last, files not closed are rejected by readers
+	if err := seg.Close(); err != nil {
+		return 0, err
+	}
+	manifest.addSegment(seg)
+	if err := manifest.write(dir); err != nil {
+		return 0, err
+	}
+	if err := idxer.snapshot(dir); err != nil {
+		return 0, err
+	}
+	return seg.id + 1, nil
+}
+
+// read back the index files of build dir
+// and save a snapshot and a mph of the index for server
+func (idxer *Indexer) snapshot(dir string) error {
+	db, err := openDb(idxer.cfg, dir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := db.loadIndex(); err != nil {
+		return err
+	}
+	if err := db.Save(); err != nil {
+		return err
+	}
+	mph, err := BuildMph(db.index)
+	if err != nil {
+		return err
+	}
+	return writeMph(dir, db.source, mph)
 }
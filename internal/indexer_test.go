@@ -0,0 +1,38 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// a data file ending in the middle of a value is corrupt,
+// whether the value is small or a large object
+func TestIndexerTruncatedValue(t *testing.T) {
+	for _, size := range []int{100, 3 * minValPageSize} {
+		cfg := testConfig(t)
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.BigEndian, uint32(3))
+		buf.WriteString("key")
+		binary.Write(&buf, binary.BigEndian, uint64(size))
+		buf.Write(make([]byte, size/2))
+		if err := ioutil.WriteFile(cfg.DataPath, buf.Bytes(), 0640); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(cfg.StoreDir, 0750); err != nil {
+			t.Fatal(err)
+		}
+		idxer, err := NewIndexer(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = idxer.Run()
+		if !errors.Is(err, ErrCorrupt) || ExitCode(err) != exitCorrupt {
+			t.Errorf("value of %d bytes truncated: error %v, exit code %d", size, err, ExitCode(err))
+		}
+	}
+}
@@ -2,29 +2,46 @@ package internal
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
 	"github.com/pkg/errors"
 	"golang.org/x/exp/mmap"
+	"hash"
+	"hash/crc32"
 	"io"
 	"os"
+	"sync"
 )
 
 const (
 	defaultHeaderKeySize   = 4
 	defaultIdxPageSize     = 32 * 1024 * 1024
 	defaultIdxfileFilename = "%09d.idx"
-	idxHeaderSize          = 4 * 4
-	idxFilePath            = "/tmp/00000000.idx"
+	idxHeaderSize          = 4*2 + posSize
+	idxLargeMarker         = ^uint32(0)
+	idxLargeHeaderSize     = 4*2 + posSize
 )
 
 // index page struct
 // default 32mb
-// 
 //
-// +--------+----------+------------+------------+------------+--------+
-// | count  | keySizes | keyOffsets | valPageIds | valOffsets |  buf   |
-// | uint32 | []uint32 |  []uint32  |  []uint32  | []uint32   | []byte |
-// +--------+----------+------------+------------+------------+--------+
+// positions are the packed Pos of values, see Pos
+// checksum is the crc32c of the page before it
+//
+// +--------+----------+------------+-----------+--------+----------+
+// | count  | keySizes | keyOffsets | positions |  buf   | checksum |
+// | uint32 | []uint32 |  []uint32  | []uint64  | []byte |  uint32  |
+// +--------+----------+------------+-----------+--------+----------+
+//
+// a key too large for a page is stored as a large key,
+// it starts at a page boundary and spans as many pages as it needs,
+// the marker takes the place of count,
+// checksum is the crc32c of the header and key
+//
+// +--------+---------+----------+--------+----------+----------------------+
+// | marker | keySize | position |  key   | checksum |       padding        |
+// | uint32 | uint32  |  uint64  | []byte |  uint32  | continues next pages |
+// +--------+---------+----------+--------+----------+----------------------+
 type IdxPage struct {
 	pageSize   uint32
 	usedSize   uint32
@@ -32,21 +49,19 @@ type IdxPage struct {
 	count      uint32
 	keySizes   []uint32
 	keyOffsets []uint32
-	valPageIds []uint32
-	valOffsets []uint32
+	positions  []Pos
 	buf        []byte
 }
 
 func NewIdxPage(pageSize uint32) (*IdxPage, error) {
 
-	usedSize := uint32(4)
+	usedSize := uint32(defaultHeaderKeySize + checksumSize)
 	bufOffset := uint32(0)
 
 	count := uint32(0)
 	keySizes := make([]uint32, 0)
 	keyOffsets := make([]uint32, 0)
-	valPageIds := make([]uint32, 0)
-	valOffsets := make([]uint32, 0)
+	positions := make([]Pos, 0)
 	buf := make([]byte, pageSize)
 
 	return &IdxPage{
@@ -56,22 +71,20 @@ func NewIdxPage(pageSize uint32) (*IdxPage, error) {
 		count:      count,
 		keySizes:   keySizes,
 		keyOffsets: keyOffsets,
-		valPageIds: valPageIds,
-		valOffsets: valOffsets,
+		positions:  positions,
 		buf:        buf,
 	}, nil
 }
 
 // append a index item
-func (p *IdxPage) Append(keySize, valPageId, valOffset uint32, key []byte) error {
-	if keySize+idxHeaderSize+p.usedSize > p.pageSize {
+func (p *IdxPage) Append(keySize uint32, pos Pos, key []byte) error {
+	if uint64(keySize)+idxHeaderSize+uint64(p.usedSize) > uint64(p.pageSize) {
 		return errors.New("overflow")
 	}
 	copy(p.buf[p.bufOffset:p.bufOffset+keySize], key)
 	p.keySizes = append(p.keySizes, keySize)
 	p.keyOffsets = append(p.keyOffsets, p.bufOffset)
-	p.valPageIds = append(p.valPageIds, valPageId)
-	p.valOffsets = append(p.valOffsets, valOffset)
+	p.positions = append(p.positions, pos)
 
 	p.count++
 	p.bufOffset += keySize
@@ -79,41 +92,128 @@ func (p *IdxPage) Append(keySize, valPageId, valOffset uint32, key []byte) error
 	return nil
 }
 
+func (p *IdxPage) Empty() bool {
+	return p.count == 0
+}
+
+// whether a key fits in an empty page, or must be a large key
+func (p *IdxPage) Fits(keySize uint32) bool {
+	return uint64(keySize)+idxHeaderSize+defaultHeaderKeySize+checksumSize <= uint64(p.pageSize)
+}
+
+// number of pages taken by a large key
+func idxLargePages(keySize, pageSize uint32) uint64 {
+	return (idxLargeHeaderSize + uint64(keySize) + checksumSize + uint64(pageSize) - 1) / uint64(pageSize)
+}
+
+// the file header is written when the writer is closed
+//
+// crc is the checksum of pages, checksum is the checksum of whole file,
+// which is set when the writer is closed
 type IdxPageWriter struct {
-	f      *os.File
-	enc    *IdxEncoder
-	offset uint32
+	f        *os.File
+	enc      *IdxEncoder
+	offset   uint64
+	header   *FileHeader
+	crc      hash.Hash32
+	checksum uint32
+	minKey   []byte
+	maxKey   []byte
 }
 
-func NewIdxPageWriter(path string) (*IdxPageWriter, error) {
-	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
-	w := bufio.NewWriter(f)
+func NewIdxPageWriter(path string, pageSize uint32) (*IdxPageWriter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0640)
+	if err != nil {
+		return &IdxPageWriter{}, ioError(err)
+	}
+	// reserve space of header
+	if _, err := f.Write(make([]byte, fileHeaderSize)); err != nil {
+		f.Close()
+		return &IdxPageWriter{}, ioError(errors.Wrap(err, "failed writing index file header"))
+	}
+	crc := crc32.New(crcTable)
+	w := bufio.NewWriter(io.MultiWriter(f, crc))
 
-	offset := uint32(0)
+	offset := uint64(0)
 	enc := NewIdxEncoder(w)
+	header := newFileHeader(idxFileMagic, uint64(pageSize))
 
 	return &IdxPageWriter{
 		f:      f,
 		enc:    enc,
 		offset: offset,
+		header: header,
+		crc:    crc,
 	}, nil
 }
 
-// write index to disk
-func (pw *IdxPageWriter) Write(p *IdxPage) (uint32, uint32, error) {
+// write a page to disk
+// return the offset of file after write and the size written
+func (pw *IdxPageWriter) Write(p *IdxPage) (uint64, uint64, error) {
 	if pw.f == nil {
 		return 0, 0, errors.New("file error")
 	}
 
 	n, err := pw.enc.Encode(p)
 	if err != nil {
-		return 0, 0, err
+		return 0, 0, ioError(err)
 	}
 	pw.offset += n
+	pw.header.RecordCount += uint64(p.count)
+	for i := uint32(0); i < p.count; i++ {
+		pw.addKey(p.buf[p.keyOffsets[i] : p.keyOffsets[i]+p.keySizes[i]])
+	}
 
 	return pw.offset, n, nil
 }
 
+// write a large key with its position
+// return the offset of file after write and the size written
+func (pw *IdxPageWriter) WriteLarge(keySize, pageSize uint32, pos Pos, key []byte) (uint64, uint64, error) {
+	if pw.f == nil {
+		return 0, 0, errors.New("file error")
+	}
+
+	n, err := pw.enc.EncodeLarge(keySize, pageSize, pos, key)
+	if err != nil {
+		return 0, 0, ioError(err)
+	}
+	pw.offset += n
+	pw.header.RecordCount++
+	pw.addKey(key[0:keySize])
+
+	return pw.offset, n, nil
+}
+
+// keep the min and max key written
+func (pw *IdxPageWriter) addKey(key []byte) {
+	if pw.minKey == nil || bytes.Compare(key, pw.minKey) < 0 {
+		pw.minKey = append([]byte{}, key...)
+	}
+	if pw.maxKey == nil || bytes.Compare(key, pw.maxKey) > 0 {
+		pw.maxKey = append([]byte{}, key...)
+	}
+}
+
+// write file header, sync and close file
+func (pw *IdxPageWriter) Close() error {
+	if pw.f == nil {
+		return errors.New("file error")
+	}
+	pw.header.PageCount = pw.offset / pw.header.PageSize
+	header := pw.header.encode()
+	if _, err := pw.f.WriteAt(header, 0); err != nil {
+		pw.f.Close()
+		return ioError(errors.Wrap(err, "failed writing index file header"))
+	}
+	pw.checksum = combineChecksum(checksum(header), pw.crc.Sum32(), pw.offset)
+	if err := pw.f.Sync(); err != nil {
+		pw.f.Close()
+		return ioError(errors.Wrap(err, "failed syncing index file"))
+	}
+	return ioError(pw.f.Close())
+}
+
 type IdxEncoder struct {
 	w *bufio.Writer
 }
@@ -123,90 +223,154 @@ func NewIdxEncoder(w io.Writer) *IdxEncoder {
 }
 
 // encode index data to disk format
-func (e *IdxEncoder) Encode(p *IdxPage) (uint32, error) {
+func (e *IdxEncoder) Encode(p *IdxPage) (uint64, error) {
+	h := crc32.New(crcTable)
+	w := io.MultiWriter(e.w, h)
 	headerBuf := make([]byte, defaultHeaderKeySize)
 	binary.BigEndian.PutUint32(headerBuf, p.count)
-	if _, err := e.w.Write(headerBuf); err != nil {
+	if _, err := w.Write(headerBuf); err != nil {
 		return 0, errors.Wrap(err, "failed writing index header count")
 	}
 	for i := uint32(0); i < p.count; i++ {
 		binary.BigEndian.PutUint32(headerBuf, p.keySizes[i])
-		if _, err := e.w.Write(headerBuf); err != nil {
+		if _, err := w.Write(headerBuf); err != nil {
 			return 0, errors.Wrap(err, "failed writing index header keySize")
 		}
 	}
 	for i := uint32(0); i < p.count; i++ {
 		binary.BigEndian.PutUint32(headerBuf, p.keyOffsets[i])
-		if _, err := e.w.Write(headerBuf); err != nil {
+		if _, err := w.Write(headerBuf); err != nil {
 			return 0, errors.Wrap(err, "failed writing index header keyOffset")
 		}
 	}
+	posBuf := make([]byte, posSize)
 	for i := uint32(0); i < p.count; i++ {
-		binary.BigEndian.PutUint32(headerBuf, p.valPageIds[i])
-		if _, err := e.w.Write(headerBuf); err != nil {
-			return 0, errors.Wrap(err, "failed writing index header valuePageId")
-		}
-	}
-	for i := uint32(0); i < p.count; i++ {
-		binary.BigEndian.PutUint32(headerBuf, p.valOffsets[i])
-		if _, err := e.w.Write(headerBuf); err != nil {
-			return 0, errors.Wrap(err, "failed writing index header valueOffset")
+		binary.BigEndian.PutUint64(posBuf, uint64(p.positions[i]))
+		if _, err := w.Write(posBuf); err != nil {
+			return 0, errors.Wrap(err, "failed writing index header position")
 		}
 	}
 
 	// page alignment
-	baseOff := defaultHeaderKeySize + p.count*4*defaultHeaderKeySize
-	if _, err := e.w.Write(p.buf[0 : defaultIdxPageSize-baseOff]); err != nil {
+	baseOff := defaultHeaderKeySize + p.count*idxHeaderSize
+	if _, err := w.Write(p.buf[0 : p.pageSize-baseOff-checksumSize]); err != nil {
 		return 0, errors.Wrap(err, "failed writing index buf")
 	}
+	binary.BigEndian.PutUint32(headerBuf, h.Sum32())
+	if _, err := e.w.Write(headerBuf); err != nil {
+		return 0, errors.Wrap(err, "failed writing index page checksum")
+	}
 	if err := e.w.Flush(); err != nil {
 		return 0, errors.Wrap(err, "failed flushing index page")
 	}
 
-	return uint32(1), nil
+	return uint64(p.pageSize), nil
 }
 
+// encode a large key to disk format, padded to page boundary
+func (e *IdxEncoder) EncodeLarge(keySize, pageSize uint32, pos Pos, key []byte) (uint64, error) {
+	h := crc32.New(crcTable)
+	w := io.MultiWriter(e.w, h)
+	headerBuf := make([]byte, idxLargeHeaderSize)
+	binary.BigEndian.PutUint32(headerBuf, idxLargeMarker)
+	binary.BigEndian.PutUint32(headerBuf[defaultHeaderKeySize:], keySize)
+	binary.BigEndian.PutUint64(headerBuf[defaultHeaderKeySize*2:], uint64(pos))
+	if _, err := w.Write(headerBuf); err != nil {
+		return 0, errors.Wrap(err, "failed writing large key header")
+	}
+	if _, err := w.Write(key[0:keySize]); err != nil {
+		return 0, errors.Wrap(err, "failed writing large key")
+	}
+	binary.BigEndian.PutUint32(headerBuf, h.Sum32())
+	if _, err := e.w.Write(headerBuf[0:checksumSize]); err != nil {
+		return 0, errors.Wrap(err, "failed writing large key checksum")
+	}
+
+	// page alignment
+	n := idxLargePages(keySize, pageSize) * uint64(pageSize)
+	padding := n - idxLargeHeaderSize - uint64(keySize) - checksumSize
+	if _, err := e.w.Write(make([]byte, padding)); err != nil {
+		return 0, errors.Wrap(err, "failed writing large key padding")
+	}
+	if err := e.w.Flush(); err != nil {
+		return 0, errors.Wrap(err, "failed flushing large key")
+	}
+
+	return n, nil
+}
+
+// IdxReader is safe for concurrent use,
+// every read uses its own buffer from pool
+// every page is verified against its checksum
+// offsets are relative to the end of file header
 type IdxReader struct {
-	reader *mmap.ReaderAt
-	l      uint32
-	buf    []byte
+	reader   *mmap.ReaderAt
+	header   *FileHeader
+	l        uint64
+	pageSize uint32
+	pool     *sync.Pool
 }
 
-func NewIdxReader() (*IdxReader, error) {
-	reader, err := mmap.Open(idxFilePath)
+// the file is refused if its header is not compatible with pageSize
+func NewIdxReader(path string, pageSize uint32) (*IdxReader, error) {
+	reader, err := mmap.Open(path)
+	if err != nil {
+		return &IdxReader{}, ioError(err)
+	}
+	header, l, err := readFileHeader(reader, path, idxFileMagic, uint64(pageSize))
 	if err != nil {
+		reader.Close()
 		return &IdxReader{}, err
 	}
-	l := uint32(reader.Len())
-	buf := make([]byte, defaultIdxPageSize)
+	pool := &sync.Pool{
+		New: func() interface{} {
+			buf := make([]byte, pageSize)
+			return &buf
+		},
+	}
 
 	return &IdxReader{
-		reader: reader,
-		l:      l,
-		buf:    buf,
+		reader:   reader,
+		header:   header,
+		l:        l,
+		pageSize: pageSize,
+		pool:     pool,
 	}, nil
 }
 
-// read data from disk
-func (r *IdxReader) ReadAt(offset uint32) ([]byte, error) {
-	if offset > r.l {
-		return nil, errors.New("overflow")
+// read data from disk into buf
+func (r *IdxReader) ReadAt(buf []byte, offset uint64) error {
+	if offset >= r.l {
+		return newCorruptError("index offset %d overflow", offset)
 	}
-	n, err := r.reader.ReadAt(r.buf, int64(offset))
+	n, err := r.reader.ReadAt(buf, int64(offset+fileHeaderSize))
 	if err != nil {
-		return nil, err
+		return ioError(err)
 	}
 	if n == 0 {
-		return nil, errors.New("no data")
+		return newCorruptError("no index data at offset %d", offset)
 	}
-	return r.buf, nil
+	return nil
+}
+
+func (r *IdxReader) Header() *FileHeader {
+	return r.header
+}
+
+func (r *IdxReader) Close() error {
+	return r.reader.Close()
 }
 
 // read data from disk and get keys
-func (r *IdxReader) Read(offset uint32) ([][]byte, []uint32, []uint32, error) {
-	buf, err := r.ReadAt(offset)
-	if err != nil {
-		return nil, nil, nil, err
+// keys are copied out of the page buffer, which is put back to pool
+// return the keys, their positions and the size read,
+// which is more than a page for a large key
+func (r *IdxReader) Read(offset uint64) ([][]byte, []Pos, uint64, error) {
+	bufp := r.pool.Get().(*[]byte)
+	defer r.pool.Put(bufp)
+	buf := *bufp
+	if err := r.ReadAt(buf, offset); err != nil {
+		return nil, nil, 0, err
 	}
 	kOff := 0
 	tmpBuf := make([]byte, defaultHeaderKeySize)
@@ -214,11 +378,21 @@ func (r *IdxReader) Read(offset uint32) ([][]byte, []uint32, []uint32, error) {
 	count := binary.BigEndian.Uint32(tmpBuf)
 	kOff += defaultHeaderKeySize
 
-	baseOff := defaultHeaderKeySize + count*4*defaultHeaderKeySize
+	if count == idxLargeMarker {
+		return r.readLarge(buf, offset)
+	}
+	end := r.pageSize - checksumSize
+	if err := verifyChecksum(buf[:end], buf[end:], "index page", offset); err != nil {
+		return nil, nil, 0, err
+	}
+	if uint64(defaultHeaderKeySize)+uint64(count)*idxHeaderSize > uint64(end) {
+		return nil, nil, 0, newCorruptError("index page count %d overflow at offset %d", count, offset)
+	}
+
+	baseOff := defaultHeaderKeySize + count*idxHeaderSize
 	keySizes := make([]uint32, count)
 	keyOffsets := make([]uint32, count)
-	valPageIds := make([]uint32, count)
-	valOffsets := make([]uint32, count)
+	positions := make([]Pos, count)
 	keys := make([][]byte, count)
 	for i := uint32(0); i < count; i++ {
 		copy(tmpBuf, buf[kOff:kOff+defaultHeaderKeySize])
@@ -233,16 +407,9 @@ func (r *IdxReader) Read(offset uint32) ([][]byte, []uint32, []uint32, error) {
 		kOff += defaultHeaderKeySize
 	}
 	for i := uint32(0); i < count; i++ {
-		copy(tmpBuf, buf[kOff:kOff+defaultHeaderKeySize])
-		valPageId := binary.BigEndian.Uint32(tmpBuf)
-		valPageIds[i] = valPageId
-		kOff += defaultHeaderKeySize
-	}
-	for i := uint32(0); i < count; i++ {
-		copy(tmpBuf, buf[kOff:kOff+defaultHeaderKeySize])
-		valOffset := binary.BigEndian.Uint32(tmpBuf)
-		valOffsets[i] = valOffset
-		kOff += defaultHeaderKeySize
+		pos := binary.BigEndian.Uint64(buf[kOff : kOff+posSize])
+		positions[i] = Pos(pos)
+		kOff += posSize
 	}
 	for i := uint32(0); i < count; i++ {
 		keyBuf := make([]byte, keySizes[i])
@@ -250,5 +417,43 @@ func (r *IdxReader) Read(offset uint32) ([][]byte, []uint32, []uint32, error) {
 		keys[i] = keyBuf
 	}
 
-	return keys, valPageIds, valOffsets, nil
+	return keys, positions, uint64(r.pageSize), nil
+}
+
+// size of the page or large key at offset, only its header is read,
+// so pages are found without decoding them
+func (r *IdxReader) Size(offset uint64) (uint64, error) {
+	var head [defaultHeaderKeySize * 2]byte
+	if err := r.ReadAt(head[:], offset); err != nil {
+		return 0, err
+	}
+	if binary.BigEndian.Uint32(head[:]) != idxLargeMarker {
+		return uint64(r.pageSize), nil
+	}
+	keySize := binary.BigEndian.Uint32(head[defaultHeaderKeySize:])
+	n := idxLargePages(keySize, r.pageSize) * uint64(r.pageSize)
+	if offset+n > r.l {
+		return 0, newCorruptError("large key size %d overflow at offset %d", keySize, offset)
+	}
+	return n, nil
+}
+
+// read a large key starting at offset, buf holds its first page
+func (r *IdxReader) readLarge(buf []byte, offset uint64) ([][]byte, []Pos, uint64, error) {
+	keySize := binary.BigEndian.Uint32(buf[defaultHeaderKeySize:])
+	pos := binary.BigEndian.Uint64(buf[defaultHeaderKeySize*2:])
+	n := idxLargePages(keySize, r.pageSize) * uint64(r.pageSize)
+	if offset+n > r.l {
+		return nil, nil, 0, newCorruptError("large key size %d overflow at offset %d", keySize, offset)
+	}
+	end := idxLargeHeaderSize + uint64(keySize)
+	rec := make([]byte, end+checksumSize)
+	if err := r.ReadAt(rec, offset); err != nil {
+		return nil, nil, 0, err
+	}
+	if err := verifyChecksum(rec[:end], rec[end:], "large key", offset); err != nil {
+		return nil, nil, 0, err
+	}
+	key := rec[idxLargeHeaderSize:end:end]
+	return [][]byte{key}, []Pos{Pos(pos)}, n, nil
 }
@@ -0,0 +1,80 @@
+package internal
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+// an index file over 4GB, index files are not limited by Pos,
+// a large key starts a page before 4GB and crosses it,
+// a page of keys follows it
+func TestIdxReaderSparse(t *testing.T) {
+	pageSize := uint32(testSparsePageSize)
+	largeOff := uint64(1<<32) - uint64(pageSize)
+
+	largeKey := bytes.Repeat([]byte("large key "), int(pageSize)/5)
+	largePos, _ := NewIndirectPos(posMaxSegment, posMaxOffset-uint64(testSparsePageSize)+1)
+	var buf bytes.Buffer
+	n, err := NewIdxEncoder(&buf).EncodeLarge(uint32(len(largeKey)), pageSize, largePos, largeKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	largePages := append([]byte(nil), buf.Bytes()...)
+	pageOff := largeOff + n
+	if pageOff <= 1<<32 {
+		t.Fatalf("large key of %d bytes does not cross 4GB", n)
+	}
+
+	keys := [][]byte{[]byte("key-a"), []byte("key-b")}
+	positions := make([]Pos, len(keys))
+	page, _ := NewIdxPage(pageSize)
+	for i, key := range keys {
+		positions[i], _ = NewPos(posMaxSegment, posMaxOffset-uint64(i), uint64(i+1))
+		page.Append(uint32(len(key)), positions[i], key)
+	}
+	buf.Reset()
+	if _, err := NewIdxEncoder(&buf).Encode(page); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "000000000.idx")
+	pageCount := pageOff/uint64(pageSize) + 1
+	writeSparseFile(t, path, idxFileMagic, uint64(pageSize), pageCount, 3, map[uint64][]byte{
+		largeOff: largePages,
+		pageOff:  buf.Bytes(),
+	})
+	ir, err := NewIdxReader(path, pageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ir.Close()
+
+	if size, err := ir.Size(largeOff); err != nil || size != n {
+		t.Errorf("Size(%d) = %d, %v, want %d", largeOff, size, err, n)
+	}
+	gotKeys, gotPositions, size, err := ir.Read(largeOff)
+	if err != nil || size != n || len(gotKeys) != 1 {
+		t.Fatalf("Read(%d) = %d keys of size %d, %v", largeOff, len(gotKeys), size, err)
+	}
+	if !bytes.Equal(gotKeys[0], largeKey) || gotPositions[0] != largePos {
+		t.Errorf("Read(%d) = %.20q at %x, want %.20q at %x", largeOff, gotKeys[0], uint64(gotPositions[0]), largeKey, uint64(largePos))
+	}
+
+	if size, err := ir.Size(pageOff); err != nil || size != uint64(pageSize) {
+		t.Errorf("Size(%d) = %d, %v, want %d", pageOff, size, err, pageSize)
+	}
+	gotKeys, gotPositions, _, err = ir.Read(pageOff)
+	if err != nil || len(gotKeys) != len(keys) {
+		t.Fatalf("Read(%d) = %d keys, %v", pageOff, len(gotKeys), err)
+	}
+	for i := range keys {
+		if !bytes.Equal(gotKeys[i], keys[i]) || gotPositions[i] != positions[i] {
+			t.Errorf("Read(%d) key %d = %q at %x, want %q at %x", pageOff, i, gotKeys[i], uint64(gotPositions[i]), keys[i], uint64(positions[i]))
+		}
+	}
+
+	if _, _, _, err := ir.Read(pageOff + uint64(pageSize)); err == nil {
+		t.Error("read past the end of index file succeeded")
+	}
+}
@@ -0,0 +1,211 @@
+package internal
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+)
+
+const (
+	// index pages in flight per decoder
+	loadPagesPerWorker = 4
+	loadProgressPeriod = time.Second
+)
+
+// a page or large key of an index file to decode,
+// seq is its order in all index files
+type loadJob struct {
+	seq     int
+	segment int
+	ir      *IdxReader
+	offset  uint64
+	n       uint64
+}
+
+type loadResult struct {
+	job       loadJob
+	keys      [][]byte
+	positions []Pos
+	err       error
+}
+
+type loadBatch struct {
+	keys      [][]byte
+	positions []Pos
+}
+
+// read index files and build the sharded index
+// every page of index files is read, any error fails loading,
+// and the keys of a segment must match the count in its header
+//
+// pages are decoded concurrently by a decoder per cpu, the keys are
+// handed to shards in page order and every shard inserts its keys
+// in its own goroutine, so a key appears more than once takes the
+// position of its last record, as if pages were loaded one by one
+func (db *Db) loadIndex() error {
+	workers := runtime.GOMAXPROCS(0)
+	shards := len(db.index.shards)
+
+	jobs := make(chan loadJob)
+	results := make(chan loadResult, workers)
+	window := make(chan struct{}, workers*loadPagesPerWorker)
+	stop := make(chan struct{})
+
+	// find pages by their headers
+	var findErr error
+	go func() {
+		defer close(jobs)
+		seq := 0
+		for id, ir := range db.irs {
+			for offset := uint64(0); offset < ir.l; {
+				n, err := ir.Size(offset)
+				if err != nil {
+					findErr = err
+					return
+				}
+				select {
+				case window <- struct{}{}:
+				case <-stop:
+					return
+				}
+				jobs <- loadJob{seq: seq, segment: id, ir: ir, offset: offset, n: n}
+				seq++
+				offset += n
+			}
+		}
+	}()
+
+	// decode pages
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				keys, positions, _, err := job.ir.Read(job.offset)
+				results <- loadResult{job: job, keys: keys, positions: positions, err: err}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// insert keys into shards
+	batches := make([]chan loadBatch, shards)
+	var sg sync.WaitGroup
+	for i := range batches {
+		batches[i] = make(chan loadBatch, loadPagesPerWorker)
+		sg.Add(1)
+		go func(index Index, batches <-chan loadBatch) {
+			defer sg.Done()
+			for b := range batches {
+				for i := range b.keys {
+					index.Insert(b.keys[i], b.positions[i])
+				}
+			}
+			// a sorted index is sorted by Len, not by the first search
+			index.Len()
+		}(db.index.shards[i], batches[i])
+	}
+
+	// hand keys to shards in page order
+	progress := newLoadProgress(db.irs)
+	counts := make([]uint64, len(db.irs))
+	pending := make(map[int]loadResult)
+	next := 0
+	var err error
+	for res := range results {
+		pending[res.job.seq] = res
+		for {
+			res, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
+			<-window
+			if err != nil {
+				continue
+			}
+			if res.err != nil {
+				err = res.err
+				close(stop)
+				continue
+			}
+			split := make([]loadBatch, shards)
+			for i, key := range res.keys {
+				b := &split[db.index.shard(key)]
+				b.keys = append(b.keys, key)
+				b.positions = append(b.positions, res.positions[i])
+			}
+			for i, b := range split {
+				if len(b.keys) > 0 {
+					batches[i] <- b
+				}
+			}
+			counts[res.job.segment] += uint64(len(res.keys))
+			progress.add(res.job.n/uint64(res.job.ir.pageSize), uint64(len(res.keys)))
+		}
+	}
+	for _, b := range batches {
+		close(b)
+	}
+	sg.Wait()
+
+	if err == nil {
+		err = findErr
+	}
+	if err != nil {
+		return err
+	}
+	for id, ir := range db.irs {
+		if counts[id] != ir.header.RecordCount {
+			return newCorruptError("segment %d has %d keys, expected %d", id, counts[id], ir.header.RecordCount)
+		}
+	}
+	progress.log()
+	return nil
+}
+
+// progress of loading index files, logged periodically
+type loadProgress struct {
+	start time.Time
+	last  time.Time
+	total uint64
+	pages uint64
+	keys  uint64
+}
+
+func newLoadProgress(irs []*IdxReader) *loadProgress {
+	total := uint64(0)
+	for _, ir := range irs {
+		total += ir.header.PageCount
+	}
+	now := time.Now()
+	return &loadProgress{start: now, last: now, total: total}
+}
+
+// pages of index with keys are loaded
+func (p *loadProgress) add(pages, keys uint64) {
+	p.pages += pages
+	p.keys += keys
+	if time.Since(p.last) >= loadProgressPeriod {
+		p.log()
+	}
+}
+
+// log pages and keys loaded and the time left,
+// which is estimated by the rate so far
+func (p *loadProgress) log() {
+	p.last = time.Now()
+	elapsed := p.last.Sub(p.start)
+	eta := time.Duration(0)
+	if p.pages > 0 {
+		eta = time.Duration(float64(elapsed) * float64(p.total-p.pages) / float64(p.pages))
+	}
+	fmt.Printf("loading index, %d/%d pages, %d keys, elapsed %s, eta %s\n",
+		p.pages, p.total, p.keys, elapsed.Round(time.Millisecond), eta.Round(time.Second))
+}
@@ -0,0 +1,21 @@
+//go:build windows
+// +build windows
+
+package internal
+
+import (
+	"os"
+)
+
+// lock file by creating it exclusively,
+// a lock left by a crashed process must be removed by hand
+func lockFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0640)
+}
+
+func unlockFile(f *os.File) error {
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Remove(f.Name())
+}
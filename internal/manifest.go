@@ -0,0 +1,143 @@
+package internal
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	manifestFile    = "MANIFEST"
+	manifestVersion = 1
+)
+
+// manifest of a build, written at the end of build into the build dir,
+// it is the only source of what a build contains, see store.go
+//
+// the manifest is json, keys are base64 as they may be binary,
+// checksum is the crc32c of whole file including file header
+type Manifest struct {
+	Version     uint32            `json:"version"`
+	CreatedAt   int64             `json:"created_at"`
+	IdxPageSize uint64            `json:"idx_page_size"`
+	ValPageSize uint64            `json:"val_page_size"`
+	RecordCount uint64            `json:"record_count"`
+	Segments    []ManifestSegment `json:"segments"`
+}
+
+type ManifestSegment struct {
+	Id          uint32       `json:"id"`
+	RecordCount uint64       `json:"record_count"`
+	MinKey      []byte       `json:"min_key"`
+	MaxKey      []byte       `json:"max_key"`
+	Idx         ManifestFile `json:"idx"`
+	Val         ManifestFile `json:"val"`
+}
+
+type ManifestFile struct {
+	Name        string `json:"name"`
+	Size        uint64 `json:"size"`
+	PageCount   uint64 `json:"page_count"`
+	RecordCount uint64 `json:"record_count"`
+	Checksum    uint32 `json:"checksum"`
+}
+
+func NewManifest(idxPageSize, valPageSize uint64) *Manifest {
+	return &Manifest{
+		Version:     manifestVersion,
+		CreatedAt:   time.Now().UnixNano(),
+		IdxPageSize: idxPageSize,
+		ValPageSize: valPageSize,
+		Segments:    make([]ManifestSegment, 0),
+	}
+}
+
+// add a segment, its writer must be closed
+func (m *Manifest) addSegment(w *SegmentWriter) {
+	seg := ManifestSegment{
+		Id:          w.id,
+		RecordCount: w.iw.header.RecordCount,
+		MinKey:      w.iw.minKey,
+		MaxKey:      w.iw.maxKey,
+		Idx: ManifestFile{
+			Name:        filepath.Base(w.iw.f.Name()),
+			Size:        fileHeaderSize + w.iw.offset,
+			PageCount:   w.iw.header.PageCount,
+			RecordCount: w.iw.header.RecordCount,
+			Checksum:    w.iw.checksum,
+		},
+		Val: ManifestFile{
+			Name:        filepath.Base(w.vw.f.Name()),
+			Size:        fileHeaderSize + w.vw.offset,
+			PageCount:   w.vw.header.PageCount,
+			RecordCount: w.vw.header.RecordCount,
+			Checksum:    w.vw.checksum,
+		},
+	}
+	m.Segments = append(m.Segments, seg)
+	m.RecordCount += seg.RecordCount
+}
+
+// write manifest into build dir and sync it
+func (m *Manifest) write(dir string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed encoding manifest")
+	}
+	f, err := os.OpenFile(filepath.Join(dir, manifestFile), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return ioError(errors.Wrap(err, "failed creating manifest"))
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return ioError(errors.Wrap(err, "failed writing manifest"))
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return ioError(errors.Wrap(err, "failed syncing manifest"))
+	}
+	return ioError(f.Close())
+}
+
+// read manifest of build dir
+// the segments must be numbered from 0 without gap
+func ReadManifest(dir string) (*Manifest, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, manifestFile))
+	if err != nil {
+		return nil, ioError(errors.Wrap(err, "failed reading manifest"))
+	}
+	m := &Manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, newCorruptError("failed parsing manifest of %s: %v", dir, err)
+	}
+	if m.Version != manifestVersion {
+		return nil, newConfigError("unsupported manifest version %d, expected %d", m.Version, manifestVersion)
+	}
+	if len(m.Segments) == 0 {
+		return nil, newCorruptError("no segment in manifest of %s", dir)
+	}
+	for i, seg := range m.Segments {
+		if seg.Id != uint32(i) {
+			return nil, newCorruptError("segment %d missing in manifest of %s", i, dir)
+		}
+		for _, name := range []string{seg.Idx.Name, seg.Val.Name} {
+			if name == "" || filepath.Base(name) != name {
+				return nil, newCorruptError("invalid file name '%s' of segment %d in manifest of %s", name, i, dir)
+			}
+		}
+	}
+	return m, nil
+}
+
+// check the file opened is the one in manifest
+func (f *ManifestFile) validate(header *FileHeader, size uint64) error {
+	if f.Size != size || f.PageCount != header.PageCount || f.RecordCount != header.RecordCount {
+		return newCorruptError("file %s does not match manifest, %d bytes %d pages %d records, expected %d bytes %d pages %d records",
+			f.Name, size, header.PageCount, header.RecordCount, f.Size, f.PageCount, f.RecordCount)
+	}
+	return nil
+}
@@ -0,0 +1,333 @@
+package internal
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	mphFile       = "MPH"
+	mphVersion    = 1
+	mphHeaderSize = 4*6 + 8
+	// bits of a level per key left, more bits fewer levels
+	mphGamma     = 2
+	mphMaxLevels = 32
+	// seeds tried when keys collide in 64 bit hash
+	mphMaxSeeds = 16
+	// words of a rank block
+	mphRankWords = 8
+)
+
+var mphMagic = [4]byte{'I', 'K', 'V', 'M'}
+
+// minimal perfect hash index of a static set of keys, BBHash style
+//
+// keys are hashed to 64 bits, every level is a bit array, a key is
+// placed at level l if no other key left at level l hits its bit,
+// keys colliding go on to the next level. the index of a key is the
+// rank of its bit in all levels, so n keys map to 0..n-1 with about
+// 3 bits per key. keys left after all levels are kept sorted by hash
+// in fallback and take the indexes after the levels.
+//
+// keys are not stored, a key not in the set also maps to some index,
+// it is rejected by the crc32c fingerprint of key at the index
+type Mph struct {
+	seed     uint32
+	count    uint64
+	sizes    []uint64
+	bits     []uint64
+	ranks    []uint64
+	fallback []uint64
+	fps      []uint32
+	poss     []Pos
+}
+
+// hash of key by fnv-1a with seed, mixed
+func mphKeyHash(key []byte, seed uint32) uint64 {
+	h := uint64(14695981039346656037) ^ mix64(uint64(seed))
+	for _, c := range key {
+		h ^= uint64(c)
+		h *= 1099511628211
+	}
+	return mix64(h)
+}
+
+// finalizer of splitmix64
+func mix64(h uint64) uint64 {
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
+
+// bit of hash h in a level of size bits
+func mphLevelBit(h uint64, level int, size uint64) uint64 {
+	hi, _ := bits.Mul64(mix64(h+uint64(level+1)*0x9e3779b97f4a7c15), size)
+	return hi
+}
+
+// build the mph of every key in index
+func BuildMph(index *ShardedIndex) (*Mph, error) {
+	for seed := uint32(0); seed < mphMaxSeeds; seed++ {
+		hashes := make([]uint64, 0, index.Len())
+		index.Iterate(func(key []byte, pos Pos) bool {
+			hashes = append(hashes, mphKeyHash(key, seed))
+			return true
+		})
+		sort.Slice(hashes, func(i, j int) bool { return hashes[i] < hashes[j] })
+		collided := false
+		for i := 1; i < len(hashes); i++ {
+			if hashes[i] == hashes[i-1] {
+				collided = true
+				break
+			}
+		}
+		if collided {
+			continue
+		}
+
+		m := &Mph{seed: seed, count: uint64(len(hashes))}
+		m.build(hashes, mphMaxLevels)
+		m.fps = make([]uint32, m.count)
+		m.poss = make([]Pos, m.count)
+		index.Iterate(func(key []byte, pos Pos) bool {
+			i, _ := m.lookup(mphKeyHash(key, seed))
+			m.fps[i] = checksum(key)
+			m.poss[i] = pos
+			return true
+		})
+		return m, nil
+	}
+	return nil, errors.Errorf("keys collide in hash with %d seeds", mphMaxSeeds)
+}
+
+// place hashes into at most levels levels,
+// hashes left are kept in fallback
+func (m *Mph) build(hashes []uint64, levels int) {
+	for level := 0; level < levels && len(hashes) > 0; level++ {
+		words := (uint64(len(hashes))*mphGamma + 63) / 64
+		size := words * 64
+		set := make([]uint64, words)
+		collide := make([]uint64, words)
+		for _, h := range hashes {
+			b := mphLevelBit(h, level, size)
+			if set[b/64]&(1<<(b%64)) != 0 {
+				collide[b/64] |= 1 << (b % 64)
+			}
+			set[b/64] |= 1 << (b % 64)
+		}
+		for i := range set {
+			set[i] &^= collide[i]
+		}
+		left := hashes[:0]
+		for _, h := range hashes {
+			b := mphLevelBit(h, level, size)
+			if set[b/64]&(1<<(b%64)) == 0 {
+				left = append(left, h)
+			}
+		}
+		hashes = left
+		m.sizes = append(m.sizes, size)
+		m.bits = append(m.bits, set...)
+	}
+	m.fallback = append([]uint64(nil), hashes...)
+	m.rank()
+}
+
+// count bits set before every rank block, return bits set in all levels
+func (m *Mph) rank() uint64 {
+	m.ranks = make([]uint64, (len(m.bits)+mphRankWords-1)/mphRankWords)
+	n := uint64(0)
+	for i, w := range m.bits {
+		if i%mphRankWords == 0 {
+			m.ranks[i/mphRankWords] = n
+		}
+		n += uint64(bits.OnesCount64(w))
+	}
+	return n
+}
+
+// index of hash h, false if h is in no level and not in fallback
+func (m *Mph) lookup(h uint64) (uint64, bool) {
+	offset := uint64(0)
+	for level, size := range m.sizes {
+		b := offset + mphLevelBit(h, level, size)
+		w := b / 64
+		if m.bits[w]&(1<<(b%64)) != 0 {
+			n := m.ranks[w/mphRankWords]
+			for i := w - w%mphRankWords; i < w; i++ {
+				n += uint64(bits.OnesCount64(m.bits[i]))
+			}
+			return n + uint64(bits.OnesCount64(m.bits[w]&(1<<(b%64)-1))), true
+		}
+		offset += size
+	}
+	i := sort.Search(len(m.fallback), func(i int) bool { return m.fallback[i] >= h })
+	if i < len(m.fallback) && m.fallback[i] == h {
+		return m.count - uint64(len(m.fallback)) + uint64(i), true
+	}
+	return 0, false
+}
+
+func (m *Mph) Search(key []byte) (Pos, bool) {
+	i, ok := m.lookup(mphKeyHash(key, m.seed))
+	if !ok || m.fps[i] != checksum(key) {
+		return 0, false
+	}
+	return m.poss[i], true
+}
+
+func (m *Mph) Len() int {
+	return int(m.count)
+}
+
+func (m *Mph) MemoryUsage() uint64 {
+	return uint64(len(m.bits)+len(m.ranks)+len(m.fallback))*8 + m.count*(4+posSize)
+}
+
+// mph file in build dir, big endian, source is as in snapshot.go,
+// ranks are not saved but counted when read,
+// checksum is the crc32c of all bytes before it
+//
+// +---------+---------+--------+--------+--------+----------+--------+
+// |  magic  | version | source |  seed  | levels | fallback | count  |
+// | [4]byte | uint32  | uint32 | uint32 | uint32 |  uint32  | uint64 |
+// +---------+---------+--------+--------+--------+----------+--------+
+// +----------+----------+----------+----------+-----------+----------+
+// |  sizes   |   bits   | fallback |   fps    | positions | checksum |
+// | []uint64 | []uint64 | []uint64 | []uint32 |  []uint64 |  uint32  |
+// +----------+----------+----------+----------+-----------+----------+
+func (m *Mph) encode(source uint32) []byte {
+	n := mphHeaderSize + (len(m.sizes)+len(m.bits)+len(m.fallback))*8 + int(m.count)*(4+posSize)
+	buf := make([]byte, n, n+checksumSize)
+	copy(buf[0:4], mphMagic[:])
+	binary.BigEndian.PutUint32(buf[4:], mphVersion)
+	binary.BigEndian.PutUint32(buf[8:], source)
+	binary.BigEndian.PutUint32(buf[12:], m.seed)
+	binary.BigEndian.PutUint32(buf[16:], uint32(len(m.sizes)))
+	binary.BigEndian.PutUint32(buf[20:], uint32(len(m.fallback)))
+	binary.BigEndian.PutUint64(buf[24:], m.count)
+	off := mphHeaderSize
+	for _, words := range [][]uint64{m.sizes, m.bits, m.fallback} {
+		for _, w := range words {
+			binary.BigEndian.PutUint64(buf[off:], w)
+			off += 8
+		}
+	}
+	for _, fp := range m.fps {
+		binary.BigEndian.PutUint32(buf[off:], fp)
+		off += 4
+	}
+	for _, pos := range m.poss {
+		binary.BigEndian.PutUint64(buf[off:], uint64(pos))
+		off += posSize
+	}
+	return buf
+}
+
+// write mph into dir, replace it by rename
+func writeMph(dir string, source uint32, m *Mph) error {
+	buf := m.encode(source)
+	sum := make([]byte, checksumSize)
+	binary.BigEndian.PutUint32(sum, checksum(buf))
+	buf = append(buf, sum...)
+
+	path := filepath.Join(dir, mphFile)
+	f, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return ioError(errors.Wrap(err, "failed creating mph"))
+	}
+	_, err = f.Write(buf)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return ioError(errors.Wrap(err, "failed writing mph"))
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return ioError(errors.Wrap(err, "failed replacing mph"))
+	}
+	return syncDir(dir)
+}
+
+// read the mph of dir, a mph of other source is refused
+func readMph(dir string, source uint32) (*Mph, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(dir, mphFile))
+	if err != nil {
+		return nil, ioError(errors.Wrap(err, "failed reading mph"))
+	}
+	if len(buf) < mphHeaderSize+checksumSize {
+		return nil, newCorruptError("mph too small for header")
+	}
+	end := len(buf) - checksumSize
+	if err := verifyChecksum(buf[:end], buf[end:], "mph", 0); err != nil {
+		return nil, err
+	}
+	if string(buf[0:4]) != string(mphMagic[:]) {
+		return nil, newCorruptError("bad magic of mph")
+	}
+	if v := binary.BigEndian.Uint32(buf[4:]); v != mphVersion {
+		return nil, newConfigError("unsupported mph version %d, expected %d", v, mphVersion)
+	}
+	if s := binary.BigEndian.Uint32(buf[8:]); s != source {
+		return nil, newConfigError("stale mph of source %08x, expected %08x", s, source)
+	}
+	m := &Mph{
+		seed:  binary.BigEndian.Uint32(buf[12:]),
+		count: binary.BigEndian.Uint64(buf[24:]),
+	}
+	levels := uint64(binary.BigEndian.Uint32(buf[16:]))
+	fallback := uint64(binary.BigEndian.Uint32(buf[20:]))
+	if levels > mphMaxLevels || mphHeaderSize+levels*8 > uint64(end) || m.count > uint64(end)/(4+posSize) {
+		return nil, newCorruptError("mph of %d levels %d keys overflow", levels, m.count)
+	}
+
+	off := uint64(mphHeaderSize)
+	words := func(n uint64) []uint64 {
+		ws := make([]uint64, n)
+		for i := range ws {
+			ws[i] = binary.BigEndian.Uint64(buf[off:])
+			off += 8
+		}
+		return ws
+	}
+	m.sizes = words(levels)
+	total := uint64(0)
+	for _, size := range m.sizes {
+		if size%64 != 0 || size > uint64(end)*8 {
+			return nil, newCorruptError("mph level size %d invalid", size)
+		}
+		total += size / 64
+	}
+	if off+(total+fallback)*8+m.count*(4+posSize) != uint64(end) {
+		return nil, newCorruptError("mph of %d keys has %d bytes", m.count, len(buf))
+	}
+	m.bits = words(total)
+	m.fallback = words(fallback)
+	m.fps = make([]uint32, m.count)
+	for i := range m.fps {
+		m.fps[i] = binary.BigEndian.Uint32(buf[off:])
+		off += 4
+	}
+	m.poss = make([]Pos, m.count)
+	for i := range m.poss {
+		m.poss[i] = Pos(binary.BigEndian.Uint64(buf[off:]))
+		off += posSize
+	}
+	if m.rank()+fallback != m.count {
+		return nil, newCorruptError("mph bits do not match %d keys", m.count)
+	}
+	return m, nil
+}
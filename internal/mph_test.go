@@ -0,0 +1,131 @@
+package internal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func testMphIndex(n int) *ShardedIndex {
+	index := NewShardedIndex(indexTypeHash, 4)
+	for i := 0; i < n; i++ {
+		pos, _ := NewPos(uint32(i%3), uint64(i)*64, uint64(i%100+1))
+		index.Insert([]byte(fmt.Sprintf("key-%d", i)), pos)
+	}
+	return index
+}
+
+// every hash maps to a distinct index in [0, n), with all levels,
+// with keys left in fallback after a level and with no level at all
+func TestMphLookup(t *testing.T) {
+	const n = 10000
+	hashes := make([]uint64, n)
+	for i := range hashes {
+		hashes[i] = mphKeyHash([]byte(fmt.Sprintf("key-%d", i)), 0)
+	}
+	sort.Slice(hashes, func(i, j int) bool { return hashes[i] < hashes[j] })
+
+	for _, levels := range []int{mphMaxLevels, 1, 0} {
+		m := &Mph{count: n}
+		m.build(append([]uint64(nil), hashes...), levels)
+		if levels == 1 && len(m.fallback) == 0 {
+			t.Errorf("no hash in fallback after %d level", levels)
+		}
+		seen := make([]bool, n)
+		for _, h := range hashes {
+			i, ok := m.lookup(h)
+			if !ok || i >= n {
+				t.Fatalf("%d levels: lookup(%x) = %d, %v", levels, h, i, ok)
+			}
+			if seen[i] {
+				t.Fatalf("%d levels: index %d taken twice", levels, i)
+			}
+			seen[i] = true
+		}
+	}
+}
+
+func TestMphSearch(t *testing.T) {
+	const n = 20000
+	index := testMphIndex(n)
+	m, err := BuildMph(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Len() != n {
+		t.Fatalf("Len() = %d, want %d", m.Len(), n)
+	}
+	index.Iterate(func(key []byte, want Pos) bool {
+		if pos, ok := m.Search(key); !ok || pos != want {
+			t.Fatalf("Search(%s) = %x, %v, want %x", key, uint64(pos), ok, uint64(want))
+		}
+		return true
+	})
+	for i := 0; i < 10*n; i++ {
+		key := fmt.Sprintf("missing-%d", i)
+		if pos, ok := m.Search([]byte(key)); ok {
+			t.Fatalf("Search(%s) = %x, want not found", key, uint64(pos))
+		}
+	}
+}
+
+func TestMphFile(t *testing.T) {
+	dir := t.TempDir()
+	index := testMphIndex(5000)
+	m, err := BuildMph(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const source = 0x1234
+	if err := writeMph(dir, source, m); err != nil {
+		t.Fatal(err)
+	}
+	read, err := readMph(dir, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.Iterate(func(key []byte, want Pos) bool {
+		if pos, ok := read.Search(key); !ok || pos != want {
+			t.Fatalf("Search(%s) of mph read = %x, %v, want %x", key, uint64(pos), ok, uint64(want))
+		}
+		return true
+	})
+
+	if _, err := readMph(dir, source+1); !errors.Is(err, ErrConfig) {
+		t.Errorf("readMph of stale source error %v, want ErrConfig", err)
+	}
+
+	path := filepath.Join(dir, mphFile)
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, off := range []int{0, 20, mphHeaderSize + 8, len(buf) / 2, len(buf) - 1} {
+		bad := append([]byte(nil), buf...)
+		bad[off] ^= 0x40
+		if err := ioutil.WriteFile(path, bad, 0640); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readMph(dir, source); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("readMph of byte %d flipped error %v, want ErrCorrupt", off, err)
+		}
+	}
+	for _, size := range []int{0, mphHeaderSize, len(buf) - 8} {
+		if err := ioutil.WriteFile(path, buf[:size], 0640); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readMph(dir, source); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("readMph of %d bytes error %v, want ErrCorrupt", size, err)
+		}
+	}
+
+	os.Remove(path)
+	if _, err := readMph(dir, source); !errors.Is(err, ErrNotFound) {
+		t.Errorf("readMph of no file error %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,477 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// RESP2 protocol
+//
+// a request is an array of bulk strings
+//
+//	*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n
+//
+// a line without the leading '*' is an inline command, its arguments are
+// separated by spaces and may be quoted, see splitArgs
+//
+// replies are simple strings, errors, integers, bulk strings and arrays
+const (
+	respSimpleString = '+'
+	respError        = '-'
+	respInteger      = ':'
+	respBulkString   = '$'
+	respArray        = '*'
+
+	respIOBufSize    = 16 * 1024
+	respReplyBufSize = 64 * 1024
+	respMaxBulkSize  = 512 * 1024 * 1024
+	respMaxArraySize = 1024 * 1024
+	// memory allocated for a length sent by peer before the data arrives
+	respMaxPrealloc = 1024
+)
+
+var (
+	respCRLF          = []byte("\r\n")
+	respErrorReplacer = strings.NewReplacer("\r", " ", "\n", " ")
+)
+
+// ErrProtocol is returned when the peer sends malformed data,
+// the connection can not be resynchronized after it
+var ErrProtocol = errors.New("Protocol error")
+
+type protocolError struct {
+	msg string
+}
+
+func newProtocolError(format string, args ...interface{}) error {
+	return &protocolError{msg: fmt.Sprintf(format, args...)}
+}
+
+func (e *protocolError) Error() string {
+	return ErrProtocol.Error() + ": " + e.msg
+}
+
+func (e *protocolError) Is(target error) bool {
+	return target == ErrProtocol
+}
+
+type RespReader struct {
+	r *bufio.Reader
+}
+
+func NewRespReader(r *bufio.Reader) *RespReader {
+	return &RespReader{r: r}
+}
+
+// read a line terminated by \r\n or \n, the terminator is stripped
+// a line must fit in the buffer of the underlying reader
+func (r *RespReader) readLine() ([]byte, error) {
+	line, err := r.r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, newProtocolError("too big line")
+	}
+	if err != nil {
+		return nil, err
+	}
+	line = line[:len(line)-1]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	return line, nil
+}
+
+// parse the length after a type byte
+func (r *RespReader) readLength(line []byte, max int64) (int64, error) {
+	n, err := strconv.ParseInt(string(line[1:]), 10, 64)
+	if err != nil || n < -1 || n > max {
+		return 0, newProtocolError("invalid length '%s'", line[1:])
+	}
+	return n, nil
+}
+
+// read a bulk string payload of n bytes and its trailing \r\n
+// a payload larger than the io buffer is read into a buffer growing
+// as the bytes arrive, so a length alone does not allocate its memory
+func (r *RespReader) readBulk(n int64) ([]byte, error) {
+	var buf []byte
+	if n+2 <= respIOBufSize {
+		buf = make([]byte, n+2)
+		if _, err := io.ReadFull(r.r, buf); err != nil {
+			return nil, err
+		}
+	} else {
+		var b bytes.Buffer
+		if _, err := io.CopyN(&b, r.r, n+2); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		buf = b.Bytes()
+	}
+	if !bytes.Equal(buf[n:], respCRLF) {
+		return nil, newProtocolError("bulk string not terminated by CRLF")
+	}
+	return buf[:n], nil
+}
+
+// capacity allocated for n elements sent by peer
+func respPrealloc(n int64) int64 {
+	switch {
+	case n < 0:
+		return 0
+	case n > respMaxPrealloc:
+		return respMaxPrealloc
+	}
+	return n
+}
+
+// read a command sent by client
+// return the arguments, an empty inline line returns no arguments
+func (r *RespReader) ReadCommand() ([][]byte, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != respArray {
+		args, err := splitArgs(line)
+		if err != nil {
+			return nil, newProtocolError("%s", err)
+		}
+		return args, nil
+	}
+
+	n, err := r.readLength(line, respMaxArraySize)
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 {
+		return nil, newProtocolError("invalid multibulk length")
+	}
+	args := make([][]byte, 0, respPrealloc(n))
+	for i := int64(0); i < n; i++ {
+		line, err := r.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != respBulkString {
+			return nil, newProtocolError("expected '$', got '%s'", line)
+		}
+		size, err := r.readLength(line, respMaxBulkSize)
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, newProtocolError("invalid bulk length")
+		}
+		arg, err := r.readBulk(size)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	return args, nil
+}
+
+// reply read by client
+// Type is the RESP type byte, Null is set for null bulk strings and arrays
+type RespReply struct {
+	Type  byte
+	Str   []byte
+	Int   int64
+	Array []*RespReply
+	Null  bool
+}
+
+// read a reply sent by server
+func (r *RespReader) ReadReply() (*RespReply, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, newProtocolError("empty reply")
+	}
+
+	reply := &RespReply{Type: line[0]}
+	switch line[0] {
+	case respSimpleString, respError:
+		reply.Str = append([]byte(nil), line[1:]...)
+	case respInteger:
+		n, err := strconv.ParseInt(string(line[1:]), 10, 64)
+		if err != nil {
+			return nil, newProtocolError("invalid integer '%s'", line[1:])
+		}
+		reply.Int = n
+	case respBulkString:
+		n, err := r.readLength(line, respMaxBulkSize)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			reply.Null = true
+			break
+		}
+		if reply.Str, err = r.readBulk(n); err != nil {
+			return nil, err
+		}
+	case respArray:
+		n, err := r.readLength(line, respMaxArraySize)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			reply.Null = true
+			break
+		}
+		reply.Array = make([]*RespReply, 0, respPrealloc(n))
+		for i := int64(0); i < n; i++ {
+			elem, err := r.ReadReply()
+			if err != nil {
+				return nil, err
+			}
+			reply.Array = append(reply.Array, elem)
+		}
+	default:
+		return nil, newProtocolError("unknown reply type '%c'", line[0])
+	}
+	return reply, nil
+}
+
+type RespWriter struct {
+	w   *bufio.Writer
+	num []byte
+}
+
+func NewRespWriter(w *bufio.Writer) *RespWriter {
+	return &RespWriter{
+		w:   w,
+		num: make([]byte, 0, 20),
+	}
+}
+
+// write a type byte followed by a number and \r\n
+func (w *RespWriter) writeHeader(t byte, n int64) error {
+	w.num = strconv.AppendInt(w.num[:0], n, 10)
+	if err := w.w.WriteByte(t); err != nil {
+		return err
+	}
+	if _, err := w.w.Write(w.num); err != nil {
+		return err
+	}
+	_, err := w.w.Write(respCRLF)
+	return err
+}
+
+func (w *RespWriter) writeLine(t byte, s string) error {
+	if err := w.w.WriteByte(t); err != nil {
+		return err
+	}
+	if _, err := w.w.WriteString(s); err != nil {
+		return err
+	}
+	_, err := w.w.Write(respCRLF)
+	return err
+}
+
+func (w *RespWriter) WriteSimpleString(s string) error {
+	return w.writeLine(respSimpleString, s)
+}
+
+// newlines in the message are replaced by spaces
+func (w *RespWriter) WriteError(s string) error {
+	return w.writeLine(respError, respErrorReplacer.Replace(s))
+}
+
+func (w *RespWriter) WriteInteger(n int64) error {
+	return w.writeHeader(respInteger, n)
+}
+
+func (w *RespWriter) WriteBulk(b []byte) error {
+	if err := w.writeHeader(respBulkString, int64(len(b))); err != nil {
+		return err
+	}
+	if _, err := w.w.Write(b); err != nil {
+		return err
+	}
+	_, err := w.w.Write(respCRLF)
+	return err
+}
+
+func (w *RespWriter) WriteNull() error {
+	return w.writeHeader(respBulkString, -1)
+}
+
+// write the header of an array, the caller writes n elements after it
+func (w *RespWriter) WriteArray(n int) error {
+	return w.writeHeader(respArray, int64(n))
+}
+
+// write a command as an array of bulk strings
+func (w *RespWriter) WriteCommand(args [][]byte) error {
+	if err := w.WriteArray(len(args)); err != nil {
+		return err
+	}
+	for _, arg := range args {
+		if err := w.WriteBulk(arg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// number of bytes written but not flushed yet
+func (w *RespWriter) Buffered() int {
+	return w.w.Buffered()
+}
+
+func (w *RespWriter) Flush() error {
+	return w.w.Flush()
+}
+
+// split a line into arguments like redis-cli does
+//
+// arguments are separated by spaces, an argument may be quoted
+// inside double quotes \n \r \t \b \a \\ \" and \xHH are unescaped
+// inside single quotes only \' is unescaped
+func splitArgs(line []byte) ([][]byte, error) {
+	args := make([][]byte, 0)
+	i := 0
+	for {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+
+		arg := make([]byte, 0)
+		inDQ := false
+		inSQ := false
+		done := false
+		for !done {
+			if i == len(line) {
+				if inDQ || inSQ {
+					return nil, errors.New("unbalanced quotes")
+				}
+				break
+			}
+			c := line[i]
+			switch {
+			case inDQ:
+				if c == '\\' && i+3 < len(line) && line[i+1] == 'x' &&
+					isHexDigit(line[i+2]) && isHexDigit(line[i+3]) {
+					arg = append(arg, hexDigitValue(line[i+2])<<4|hexDigitValue(line[i+3]))
+					i += 3
+				} else if c == '\\' && i+1 < len(line) {
+					i++
+					switch line[i] {
+					case 'n':
+						c = '\n'
+					case 'r':
+						c = '\r'
+					case 't':
+						c = '\t'
+					case 'b':
+						c = '\b'
+					case 'a':
+						c = '\a'
+					default:
+						c = line[i]
+					}
+					arg = append(arg, c)
+				} else if c == '"' {
+					// closing quote must be followed by a space or nothing
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, errors.New("unbalanced quotes")
+					}
+					done = true
+				} else {
+					arg = append(arg, c)
+				}
+			case inSQ:
+				if c == '\\' && i+1 < len(line) && line[i+1] == '\'' {
+					i++
+					arg = append(arg, '\'')
+				} else if c == '\'' {
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, errors.New("unbalanced quotes")
+					}
+					done = true
+				} else {
+					arg = append(arg, c)
+				}
+			default:
+				switch c {
+				case ' ', '\n', '\r', '\t', 0:
+					done = true
+				case '"':
+					inDQ = true
+				case '\'':
+					inSQ = true
+				default:
+					arg = append(arg, c)
+				}
+			}
+			i++
+		}
+		args = append(args, arg)
+	}
+}
+
+// quote bytes like redis-cli does, printable characters are kept
+// others are escaped as \n \r \t \b \a or \xHH
+func quoteArg(b []byte) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for _, c := range b {
+		switch c {
+		case '\\', '"':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case '\n':
+			sb.WriteString("\\n")
+		case '\r':
+			sb.WriteString("\\r")
+		case '\t':
+			sb.WriteString("\\t")
+		case '\a':
+			sb.WriteString("\\a")
+		case '\b':
+			sb.WriteString("\\b")
+		default:
+			if c >= 0x20 && c < 0x7f {
+				sb.WriteByte(c)
+			} else {
+				fmt.Fprintf(&sb, "\\x%02x", c)
+			}
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\n' || c == '\r' || c == '\t' || c == '\v' || c == '\f'
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func hexDigitValue(c byte) byte {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0'
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
@@ -0,0 +1,141 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func newTestRespReader(s string) *RespReader {
+	return NewRespReader(bufio.NewReaderSize(strings.NewReader(s), respIOBufSize))
+}
+
+func TestReadCommand(t *testing.T) {
+	large := bytes.Repeat([]byte("0123456789"), 100*1024)
+	var buf bytes.Buffer
+	w := NewRespWriter(bufio.NewWriter(&buf))
+	commands := [][][]byte{
+		{[]byte("GET"), []byte("key")},
+		{[]byte("MGET"), []byte(""), []byte("a\r\nb"), large},
+	}
+	for _, cmd := range commands {
+		w.WriteCommand(cmd)
+	}
+	w.Flush()
+	buf.WriteString("get \"quoted key\"\r\n")
+	commands = append(commands, [][]byte{[]byte("get"), []byte("quoted key")})
+
+	r := newTestRespReader(buf.String())
+	for _, want := range commands {
+		args, err := r.ReadCommand()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(args) != len(want) {
+			t.Fatalf("ReadCommand() = %d args, want %d", len(args), len(want))
+		}
+		for i := range want {
+			if !bytes.Equal(args[i], want[i]) {
+				t.Errorf("arg %d = %.20q, want %.20q", i, args[i], want[i])
+			}
+		}
+	}
+}
+
+// a length sent without its data does not allocate its memory
+func TestReadCommandDeclaredLength(t *testing.T) {
+	for _, s := range []string{
+		"*1\r\n$536870000\r\nabc",
+		"*1048576\r\n$3\r\nGET\r\n",
+	} {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		_, err := newTestRespReader(s).ReadCommand()
+		runtime.ReadMemStats(&after)
+		if err == nil {
+			t.Errorf("ReadCommand(%q) of partial command succeeded", s)
+		}
+		if n := after.TotalAlloc - before.TotalAlloc; n > 1024*1024 {
+			t.Errorf("ReadCommand(%q) allocated %d bytes", s, n)
+		}
+	}
+}
+
+func TestReadCommandBadBulk(t *testing.T) {
+	for _, s := range []string{
+		"*1\r\n$3\r\nGETX\r\n",
+		"*1\r\n$-1\r\n",
+		"*1\r\n$536870913\r\n",
+		"*1\r\n:3\r\n",
+		"*-1\r\n",
+	} {
+		if _, err := newTestRespReader(s).ReadCommand(); err == nil {
+			t.Errorf("ReadCommand(%q) succeeded", s)
+		}
+	}
+}
+
+// quoteArg quotes bytes the way splitArgs reads them back
+func TestQuoteArgSplitArgs(t *testing.T) {
+	args := [][]byte{
+		[]byte("plain"),
+		[]byte(""),
+		[]byte("with space"),
+		[]byte("quote \" and \\ and '"),
+		[]byte("\n\r\t\a\b"),
+		{0, 1, 0x7f, 0x80, 0xff},
+	}
+	line := make([]string, len(args))
+	for i, arg := range args {
+		line[i] = quoteArg(arg)
+	}
+	got, err := splitArgs([]byte(strings.Join(line, " ")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(args) {
+		t.Fatalf("splitArgs() = %d args, want %d", len(got), len(args))
+	}
+	for i := range args {
+		if !bytes.Equal(got[i], args[i]) {
+			t.Errorf("arg %d = %q, want %q", i, got[i], args[i])
+		}
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	cases := []struct {
+		line string
+		args []string
+	}{
+		{"get key", []string{"get", "key"}},
+		{"  get   key  ", []string{"get", "key"}},
+		{`get "a b" 'c d'`, []string{"get", "a b", "c d"}},
+		{`get "\x41\x4a\n" 'it\'s'`, []string{"get", "AJ\n", "it's"}},
+		{"", []string{}},
+	}
+	for _, c := range cases {
+		args, err := splitArgs([]byte(c.line))
+		if err != nil {
+			t.Errorf("splitArgs(%q): %v", c.line, err)
+			continue
+		}
+		if len(args) != len(c.args) {
+			t.Errorf("splitArgs(%q) = %q, want %q", c.line, args, c.args)
+			continue
+		}
+		for i := range args {
+			if string(args[i]) != c.args[i] {
+				t.Errorf("splitArgs(%q) = %q, want %q", c.line, args, c.args)
+				break
+			}
+		}
+	}
+	for _, line := range []string{`get "key`, `get 'key`, `get "a"b`} {
+		if _, err := splitArgs([]byte(line)); err == nil {
+			t.Errorf("splitArgs(%q) of unbalanced quotes succeeded", line)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package internal
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+const (
+	defaultStoreDir    = "/tmp/ikv"
+	defaultSegmentSize = posMaxOffset + 1
+)
+
+// a build of store is a directory of segments,
+// segment n is the index file %09d.idx and the value file %09d.val
+//
+// the index file of a segment only has the keys of values in its value file,
+// a value file is rolled when it would exceed the segment size,
+// the index file is rolled with it
+//
+// the segments of a build are listed in its manifest, see manifest.go
+
+// path of the index file of segment id
+func idxSegmentPath(dir string, id uint32) string {
+	return filepath.Join(dir, fmt.Sprintf(defaultIdxfileFilename, id))
+}
+
+// path of the value file of segment id
+func valSegmentPath(dir string, id uint32) string {
+	return filepath.Join(dir, fmt.Sprintf(defaultValfileFilename, id))
+}
+
+// writers of the index file and value file of a segment
+type SegmentWriter struct {
+	id uint32
+	iw *IdxPageWriter
+	vw *ValPageWriter
+}
+
+func NewSegmentWriter(dir string, id uint32, idxPageSize uint32, valPageSize uint64) (*SegmentWriter, error) {
+	if id > posMaxSegment {
+		return &SegmentWriter{}, newConfigError("too many segments, max %d, segment_size is too small", posMaxSegment+1)
+	}
+	iw, err := NewIdxPageWriter(idxSegmentPath(dir, id), idxPageSize)
+	if err != nil {
+		return &SegmentWriter{}, err
+	}
+	vw, err := NewValPageWriter(valSegmentPath(dir, id), valPageSize)
+	if err != nil {
+		iw.Close()
+		return &SegmentWriter{}, err
+	}
+
+	return &SegmentWriter{
+		id: id,
+		iw: iw,
+		vw: vw,
+	}, nil
+}
+
+// write the file headers, sync and close files
+func (w *SegmentWriter) Close() error {
+	verr := w.vw.Close()
+	ierr := w.iw.Close()
+	if verr != nil {
+		return verr
+	}
+	return ierr
+}
@@ -3,91 +3,282 @@ package internal
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"math/rand"
 	"net"
 	"strings"
+	"sync/atomic"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
 const (
 	cmdGet            = "get"
 	cmdGetLen         = 2
-	errEmptyCmd       = "(error) ERR unknown command\n"
-	errUnknownCmd     = "(error) ERR unknown command '%s'\n"
-	errWrongNumberCmd = "(error) ERR wrong number of arguments for '%s' command\n"
-	errKeyNotExist    = "(nil)\n"
+	cmdMGet           = "mget"
+	cmdMGetMinLen     = 2
+	cmdInfo           = "info"
+	cmdInfoMaxLen     = 2
+	cmdSave           = "save"
+	cmdSaveLen        = 1
+	errUnknownCmd     = "ERR unknown command '%s'"
+	errWrongNumberCmd = "ERR wrong number of arguments for '%s' command"
+	errProtocol       = "ERR %s"
+	errCorrupt        = "CORRUPT %s"
+	errIO             = "IOERR %s"
+	errLoading        = "LOADING server is loading the index"
 )
 
+// loading is 1 until the index is loaded,
+// commands reading db are refused with errLoading before that
 type Server struct {
-	db *Db
+	cfg     *Config
+	db      *Db
+	loading int32
 }
 
-func NewServer() (*Server, error) {
-	db, err := NewDb()
+// open db, the index is loaded by Run
+func NewServer(cfg *Config) (*Server, error) {
+	db, err := NewDb(cfg)
 	if err != nil {
 		return &Server{}, err
 	}
-	db.Init()
 
 	return &Server{
-		db: db,
+		cfg:     cfg,
+		db:      db,
+		loading: 1,
 	}, nil
 }
 
-func (s *Server) Run() {
+// listen at once and load the index in background,
+// serve until the listener fails or the index fails to load
+func (s *Server) Run() error {
 	fmt.Println("run server")
 
-	port := ":6379"
-	l, err := net.Listen("tcp", port)
+	l, err := net.Listen("tcp", s.cfg.Listen)
 	if err != nil {
-		fmt.Println(err)
-		return
+		return ioError(err)
 	}
 	defer l.Close()
 	rand.Seed(time.Now().Unix())
 
+	failed := make(chan error, 1)
+	go func() {
+		if err := s.db.Init(); err != nil {
+			failed <- err
+			l.Close()
+			return
+		}
+		atomic.StoreInt32(&s.loading, 0)
+		fmt.Println("server ready")
+	}()
+
 	for {
 		c, err := l.Accept()
 		if err != nil {
-			fmt.Println(err)
-			return
+			select {
+			case err := <-failed:
+				return err
+			default:
+				return ioError(err)
+			}
 		}
 		go s.handler(c)
 	}
 }
 
+func (s *Server) ready() bool {
+	return atomic.LoadInt32(&s.loading) == 0
+}
+
+// serve one connection
+// requests are read as RESP arrays or inline commands, see resp.go
+//
+// the reader and writer live as long as the connection, so a client can
+// pipeline commands: all commands already received are executed before
+// the replies are flushed in one batch, the replies are flushed when
+// the reader has to wait for more bytes from client, see flushReader
 func (s *Server) handler(conn net.Conn) {
+	defer conn.Close()
 	fmt.Printf("Serving %s\n", conn.RemoteAddr().String())
+
+	w := NewRespWriter(bufio.NewWriterSize(conn, respReplyBufSize))
+	r := NewRespReader(bufio.NewReaderSize(&flushReader{r: conn, w: w}, respIOBufSize))
 	for {
-		data, err := bufio.NewReader(conn).ReadString('\n')
+		args, err := r.ReadCommand()
 		if err != nil {
+			if errors.Is(err, ErrProtocol) {
+				w.WriteError(fmt.Sprintf(errProtocol, err))
+				w.Flush()
+			}
 			fmt.Println(err)
 			return
 		}
-		data = strings.TrimSpace(data)
-		cmds := strings.Split(data, " ")
+		if len(args) != 0 {
+			s.exec(w, args)
+		}
+	}
+}
 
-		if len(cmds) == 0 {
-			conn.Write([]byte(errEmptyCmd))
-			continue
+// flushReader flushes the replies written before reading the connection,
+// it is only read when the bytes buffered do not hold a whole command,
+// and the read may block until client sends more
+type flushReader struct {
+	r io.Reader
+	w *RespWriter
+}
+
+func (f *flushReader) Read(p []byte) (int, error) {
+	if f.w.Buffered() > 0 {
+		if err := f.w.Flush(); err != nil {
+			return 0, err
 		}
-		cmd := strings.ToLower(cmds[0])
-		if cmd != cmdGet {
-			conn.Write([]byte(fmt.Sprintf(errUnknownCmd, cmd)))
-			continue
+	}
+	return f.r.Read(p)
+}
+
+// execute a command and write the reply
+func (s *Server) exec(w *RespWriter, args [][]byte) {
+	cmd := strings.ToLower(string(args[0]))
+	switch cmd {
+	case cmdGet:
+		if len(args) != cmdGetLen {
+			w.WriteError(fmt.Sprintf(errWrongNumberCmd, cmd))
+			return
 		}
-		if len(cmds) != cmdGetLen {
-			conn.Write([]byte(fmt.Sprintf(errWrongNumberCmd, cmd)))
-			continue
+		if !s.ready() {
+			w.WriteError(errLoading)
+			return
 		}
-		key := cmds[1]
-		value, err := s.db.Get(key)
-		if err != nil {
-			conn.Write([]byte(errKeyNotExist))
+		s.get(w, args[1])
+	case cmdMGet:
+		if len(args) < cmdMGetMinLen {
+			w.WriteError(fmt.Sprintf(errWrongNumberCmd, cmd))
+			return
+		}
+		if !s.ready() {
+			w.WriteError(errLoading)
+			return
+		}
+		s.mget(w, args[1:])
+	case cmdInfo:
+		if len(args) > cmdInfoMaxLen {
+			w.WriteError(fmt.Sprintf(errWrongNumberCmd, cmd))
+			return
+		}
+		s.info(w)
+	case cmdSave:
+		if len(args) != cmdSaveLen {
+			w.WriteError(fmt.Sprintf(errWrongNumberCmd, cmd))
+			return
+		}
+		if !s.ready() {
+			w.WriteError(errLoading)
+			return
+		}
+		s.save(w)
+	default:
+		w.WriteError(fmt.Sprintf(errUnknownCmd, cmd))
+	}
+}
+
+func (s *Server) get(w *RespWriter, key []byte) {
+	value, err := s.db.Get(string(key))
+	if err != nil {
+		s.writeGetError(w, err)
+		return
+	}
+	w.WriteBulk(value)
+}
+
+// a key not found is null, other errors are replied by kind,
+// so a client does not take a failed read as a miss
+func (s *Server) writeGetError(w *RespWriter, err error) {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		w.WriteNull()
+	case errors.Is(err, ErrCorrupt):
+		w.WriteError(fmt.Sprintf(errCorrupt, err))
+	default:
+		w.WriteError(fmt.Sprintf(errIO, err))
+	}
+}
+
+func (s *Server) mget(w *RespWriter, keys [][]byte) {
+	strKeys := make([]string, len(keys))
+	for i, key := range keys {
+		strKeys[i] = string(key)
+	}
+	values, errs := s.db.GetMany(strKeys)
+
+	w.WriteArray(len(values))
+	for i, value := range values {
+		if errs[i] != nil {
+			s.writeGetError(w, errs[i])
 			continue
 		}
-		conn.Write(value)
-		conn.Write([]byte{10})
+		w.WriteBulk(value)
+	}
+}
+
+// save a snapshot of the index, it is loaded on next start
+func (s *Server) save(w *RespWriter) {
+	if err := s.db.Save(); err != nil {
+		fmt.Println(err)
+		w.WriteError(fmt.Sprintf(errIO, err))
+		return
 	}
-	conn.Close()
+	w.WriteSimpleString("OK")
+}
+
+// write stats in the format of redis INFO
+func (s *Server) info(w *RespWriter) {
+	stats := s.db.Stats()
+	var b strings.Builder
+
+	b.WriteString("# Server\r\n")
+	fmt.Fprintf(&b, "loading:%d\r\n", atomic.LoadInt32(&s.loading))
+
+	b.WriteString("\r\n# Db\r\n")
+	fmt.Fprintf(&b, "db_gets:%d\r\n", stats.Gets)
+	fmt.Fprintf(&b, "db_not_found:%d\r\n", stats.NotFound)
+	fmt.Fprintf(&b, "db_corrupt_errors:%d\r\n", stats.Corrupt)
+	fmt.Fprintf(&b, "db_io_errors:%d\r\n", stats.IOErrors)
+
+	// the index is being built while loading
+	if s.ready() {
+		index := s.db.IndexStats()
+		b.WriteString("\r\n# Index\r\n")
+		fmt.Fprintf(&b, "index_type:%s\r\n", index.Type)
+		fmt.Fprintf(&b, "index_shards:%d\r\n", index.Shards)
+		fmt.Fprintf(&b, "index_keys:%d\r\n", index.Keys)
+		fmt.Fprintf(&b, "index_memory:%d\r\n", index.Memory)
+	}
+
+	pool := stats.BufferPool
+	b.WriteString("\r\n# Bufferpool\r\n")
+	fmt.Fprintf(&b, "bufferpool_size:%d\r\n", pool.Size)
+	fmt.Fprintf(&b, "bufferpool_used:%d\r\n", pool.Used)
+	fmt.Fprintf(&b, "bufferpool_pages:%d\r\n", pool.Pages)
+	fmt.Fprintf(&b, "bufferpool_hits:%d\r\n", pool.Hits)
+	fmt.Fprintf(&b, "bufferpool_misses:%d\r\n", pool.Misses)
+	fmt.Fprintf(&b, "bufferpool_ghost_hits:%d\r\n", pool.GhostHits)
+	fmt.Fprintf(&b, "bufferpool_admits:%d\r\n", pool.Admits)
+	fmt.Fprintf(&b, "bufferpool_evicts:%d\r\n", pool.Evicts)
+	fmt.Fprintf(&b, "bufferpool_bypasses:%d\r\n", pool.Bypasses)
+
+	cache := stats.ValueCache
+	b.WriteString("\r\n# Valuecache\r\n")
+	fmt.Fprintf(&b, "valuecache_size:%d\r\n", cache.Size)
+	fmt.Fprintf(&b, "valuecache_used:%d\r\n", cache.Used)
+	fmt.Fprintf(&b, "valuecache_items:%d\r\n", cache.Items)
+	fmt.Fprintf(&b, "valuecache_hits:%d\r\n", cache.Hits)
+	fmt.Fprintf(&b, "valuecache_misses:%d\r\n", cache.Misses)
+	fmt.Fprintf(&b, "valuecache_admits:%d\r\n", cache.Admits)
+	fmt.Fprintf(&b, "valuecache_rejects:%d\r\n", cache.Rejects)
+	fmt.Fprintf(&b, "valuecache_evicts:%d\r\n", cache.Evicts)
+
+	w.WriteBulk([]byte(b.String()))
 }
@@ -0,0 +1,209 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// serve db on a local port until the test ends, return the address
+func serveTestDb(t *testing.T, cfg *Config, db *Db) string {
+	return serveTestServer(t, &Server{cfg: cfg, db: db})
+}
+
+func serveTestServer(t *testing.T, s *Server) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.handler(c)
+		}
+	}()
+	return l.Addr().String()
+}
+
+type testClient struct {
+	conn net.Conn
+	r    *RespReader
+	w    *RespWriter
+}
+
+func dialTestServer(t *testing.T, addr string) *testClient {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testClient{
+		conn: conn,
+		r:    NewRespReader(bufio.NewReaderSize(conn, respIOBufSize)),
+		w:    NewRespWriter(bufio.NewWriterSize(conn, respIOBufSize)),
+	}
+}
+
+func (c *testClient) send(args ...string) error {
+	cmd := make([][]byte, len(args))
+	for i, arg := range args {
+		cmd[i] = []byte(arg)
+	}
+	return c.w.WriteCommand(cmd)
+}
+
+// the reply of a value, nil for a null bulk string
+func checkBulk(t *testing.T, reply *RespReply, want []byte) bool {
+	if want == nil {
+		if reply.Type != respBulkString || !reply.Null {
+			t.Errorf("reply %c %.20q, want null", reply.Type, reply.Str)
+			return false
+		}
+		return true
+	}
+	if reply.Type != respBulkString || !bytes.Equal(reply.Str, want) {
+		t.Errorf("reply %c %.20q, want %.20q", reply.Type, reply.Str, want)
+		return false
+	}
+	return true
+}
+
+func TestServerPipelinedClients(t *testing.T) {
+	cfg := testConfig(t)
+	recs := testRecords(1000)
+	db := openTestDb(t, cfg, recs)
+	addr := serveTestDb(t, cfg, db)
+	values := testValues(recs)
+
+	const depth = 16
+	var wg sync.WaitGroup
+	for g := 0; g < 32; g++ {
+		c := dialTestServer(t, addr)
+		wg.Add(1)
+		go func(g int, c *testClient) {
+			defer wg.Done()
+			for round := 0; round < 20; round++ {
+				// a batch of GET and MGET is sent before any reply is read
+				keys := make([]string, depth)
+				for i := range keys {
+					keys[i] = recs[(g*depth*20+round*depth+i)%len(recs)].key
+					if i%2 == 0 {
+						c.send("GET", keys[i])
+					} else {
+						c.send("MGET", keys[i], "missing", keys[i-1])
+					}
+				}
+				if err := c.w.Flush(); err != nil {
+					t.Error(err)
+					return
+				}
+				for i, key := range keys {
+					reply, err := c.r.ReadReply()
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if i%2 == 0 {
+						if !checkBulk(t, reply, values[key]) {
+							return
+						}
+						continue
+					}
+					if reply.Type != respArray || len(reply.Array) != 3 {
+						t.Errorf("MGET reply %c of %d elements", reply.Type, len(reply.Array))
+						return
+					}
+					if !checkBulk(t, reply.Array[0], values[key]) ||
+						!checkBulk(t, reply.Array[1], nil) ||
+						!checkBulk(t, reply.Array[2], values[keys[i-1]]) {
+						return
+					}
+				}
+			}
+		}(g, c)
+	}
+	wg.Wait()
+}
+
+// the reply of a command is flushed while the next command
+// is received only in part
+func TestServerFlushBeforeBlockingRead(t *testing.T) {
+	cfg := testConfig(t)
+	recs := testRecords(10)
+	db := openTestDb(t, cfg, recs)
+	c := dialTestServer(t, serveTestDb(t, cfg, db))
+
+	if _, err := c.conn.Write([]byte("*2\r\n$3\r\nGET\r\n$5\r\nkey-2\r\n*2\r\n$3\r\nGET\r\n$5\r\nke")); err != nil {
+		t.Fatal(err)
+	}
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply, err := c.r.ReadReply()
+	if err != nil {
+		t.Fatalf("reply of first command: %v", err)
+	}
+	checkBulk(t, reply, testValues(recs)["key-2"])
+
+	if _, err := c.conn.Write([]byte("y-3\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if reply, err = c.r.ReadReply(); err != nil {
+		t.Fatalf("reply of second command: %v", err)
+	}
+	checkBulk(t, reply, testValues(recs)["key-3"])
+}
+
+// commands reading db are refused while loading, INFO is not
+func TestServerLoading(t *testing.T) {
+	cfg := testConfig(t)
+	recs := testRecords(10)
+	db := openTestDb(t, cfg, recs)
+	s := &Server{cfg: cfg, db: db, loading: 1}
+	c := dialTestServer(t, serveTestServer(t, s))
+
+	do := func(args ...string) *RespReply {
+		if err := c.send(args...); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		reply, err := c.r.ReadReply()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+	commands := [][]string{{"GET", "key-2"}, {"MGET", "key-2", "key-3"}, {"SAVE"}}
+	for _, cmd := range commands {
+		reply := do(cmd...)
+		if reply.Type != respError || !bytes.HasPrefix(reply.Str, []byte("LOADING ")) {
+			t.Errorf("%s while loading = %c %q, want LOADING", cmd[0], reply.Type, reply.Str)
+		}
+	}
+	reply := do("INFO")
+	if reply.Type != respBulkString || !bytes.Contains(reply.Str, []byte("loading:1\r\n")) {
+		t.Errorf("INFO while loading = %c %.40q, want loading:1", reply.Type, reply.Str)
+	}
+
+	atomic.StoreInt32(&s.loading, 0)
+	checkBulk(t, do("GET", "key-2"), testValues(recs)["key-2"])
+	if reply := do("MGET", "key-2", "key-3"); reply.Type != respArray || len(reply.Array) != 2 {
+		t.Errorf("MGET after loading = %c of %d elements", reply.Type, len(reply.Array))
+	}
+	if reply := do("SAVE"); reply.Type != respSimpleString || string(reply.Str) != "OK" {
+		t.Errorf("SAVE after loading = %c %q, want OK", reply.Type, reply.Str)
+	}
+	reply = do("INFO")
+	if reply.Type != respBulkString || !bytes.Contains(reply.Str, []byte("loading:0\r\n")) ||
+		!bytes.Contains(reply.Str, []byte("# Index")) {
+		t.Errorf("INFO after loading = %c %.40q, want loading:0 and index", reply.Type, reply.Str)
+	}
+}
@@ -0,0 +1,85 @@
+package internal
+
+import "sync"
+
+const (
+	defaultIndexShards = 64
+	maxIndexShards     = 4096
+)
+
+// index split into shards by key hash, each shard is an Index,
+// so shards are built concurrently, see Db.loadIndex
+//
+// a shard is not safe for concurrent modification,
+// after building, Search may be called concurrently
+type ShardedIndex struct {
+	shards []Index
+}
+
+// n shards of index type t
+func NewShardedIndex(t string, n int) *ShardedIndex {
+	shards := make([]Index, n)
+	for i := range shards {
+		shards[i] = NewIndex(t)
+	}
+	return &ShardedIndex{shards: shards}
+}
+
+// shard of key
+func (x *ShardedIndex) shard(key []byte) int {
+	return int(checksum(key) % uint32(len(x.shards)))
+}
+
+func (x *ShardedIndex) Insert(key []byte, pos Pos) {
+	x.shards[x.shard(key)].Insert(key, pos)
+}
+
+func (x *ShardedIndex) Search(key []byte) (Pos, bool) {
+	return x.shards[x.shard(key)].Search(key)
+}
+
+// call fn on every key shard by shard
+// stop when fn returns false
+func (x *ShardedIndex) Iterate(fn func(key []byte, pos Pos) bool) {
+	stop := false
+	for _, shard := range x.shards {
+		shard.Iterate(func(key []byte, pos Pos) bool {
+			stop = !fn(key, pos)
+			return !stop
+		})
+		if stop {
+			return
+		}
+	}
+}
+
+// number of keys
+func (x *ShardedIndex) Len() int {
+	n := 0
+	for _, shard := range x.shards {
+		n += shard.Len()
+	}
+	return n
+}
+
+func (x *ShardedIndex) MemoryUsage() uint64 {
+	n := uint64(0)
+	for _, shard := range x.shards {
+		n += shard.MemoryUsage()
+	}
+	return n
+}
+
+// prepare shards for search after inserts, concurrently by shard,
+// a sorted index is sorted here instead of by the first search
+func (x *ShardedIndex) build() {
+	var wg sync.WaitGroup
+	for _, shard := range x.shards {
+		wg.Add(1)
+		go func(shard Index) {
+			defer wg.Done()
+			shard.Len()
+		}(shard)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,181 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	snapshotFile       = "SNAPSHOT"
+	snapshotVersion    = 1
+	snapshotHeaderSize = 4*4 + 8*2
+)
+
+var snapshotMagic = [4]byte{'I', 'K', 'V', 'S'}
+
+// snapshot of the index of a build, saved in the build dir
+// so server loads keys and positions directly instead of decoding
+// every index page, see Db.Init
+//
+// entries are in the order of index, source is the checksum of the index files
+// the snapshot is taken from, a snapshot whose source does not match
+// the manifest is stale. checksum is the crc32c of all bytes before it
+//
+// +---------+---------+--------+----------+--------+-----------+
+// |  magic  | version | source | reserved | count  | createdAt |
+// | [4]byte | uint32  | uint32 |  uint32  | uint64 |   int64   |
+// +---------+---------+--------+----------+--------+-----------+
+// +----------+--------+--------+-----+----------+
+// | key_size |  key   |  pos   | ... | checksum |
+// |  uint32  | []byte | uint64 |     |  uint32  |
+// +----------+--------+--------+-----+----------+
+
+// source of snapshots of the build of manifest
+func (m *Manifest) snapshotSource() uint32 {
+	buf := make([]byte, len(m.Segments)*12)
+	for i, seg := range m.Segments {
+		binary.BigEndian.PutUint32(buf[i*12:], seg.Idx.Checksum)
+		binary.BigEndian.PutUint64(buf[i*12+4:], seg.Idx.Size)
+	}
+	return checksum(buf)
+}
+
+// write the index into the snapshot file of dir,
+// it is written into a tmp file and renamed, so a reader
+// never sees a partial snapshot
+func writeSnapshot(dir string, source uint32, index *ShardedIndex) error {
+	path := filepath.Join(dir, snapshotFile)
+	f, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return ioError(errors.Wrap(err, "failed creating snapshot"))
+	}
+	crc := crc32.New(crcTable)
+	w := bufio.NewWriter(io.MultiWriter(f, crc))
+
+	header := make([]byte, snapshotHeaderSize)
+	copy(header[0:4], snapshotMagic[:])
+	binary.BigEndian.PutUint32(header[4:], snapshotVersion)
+	binary.BigEndian.PutUint32(header[8:], source)
+	binary.BigEndian.PutUint64(header[16:], uint64(index.Len()))
+	binary.BigEndian.PutUint64(header[24:], uint64(time.Now().UnixNano()))
+	_, err = w.Write(header)
+
+	entry := make([]byte, 8)
+	index.Iterate(func(key []byte, pos Pos) bool {
+		if err != nil {
+			return false
+		}
+		binary.BigEndian.PutUint32(entry, uint32(len(key)))
+		if _, err = w.Write(entry[0:4]); err != nil {
+			return false
+		}
+		if _, err = w.Write(key); err != nil {
+			return false
+		}
+		binary.BigEndian.PutUint64(entry, uint64(pos))
+		_, err = w.Write(entry)
+		return err == nil
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		binary.BigEndian.PutUint32(entry, crc.Sum32())
+		_, err = f.Write(entry[0:checksumSize])
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return ioError(errors.Wrap(err, "failed writing snapshot"))
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return ioError(errors.Wrap(err, "failed replacing snapshot"))
+	}
+	return syncDir(dir)
+}
+
+// read the snapshot of dir into index, return the number of keys
+// a snapshot of other source is refused,
+// the index is incomplete if an error is returned
+func readSnapshot(dir string, source uint32, index *ShardedIndex) (uint64, error) {
+	f, err := os.Open(filepath.Join(dir, snapshotFile))
+	if err != nil {
+		return 0, ioError(errors.Wrap(err, "failed opening snapshot"))
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, ioError(errors.Wrap(err, "failed reading snapshot"))
+	}
+	if info.Size() < snapshotHeaderSize+checksumSize {
+		return 0, newCorruptError("snapshot too small for header")
+	}
+	// size of entries
+	left := uint64(info.Size()) - snapshotHeaderSize - checksumSize
+	crc := crc32.New(crcTable)
+	r := bufio.NewReaderSize(f, dataChunkSize)
+
+	header := make([]byte, snapshotHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, ioError(errors.Wrap(err, "failed reading snapshot"))
+	}
+	crc.Write(header)
+	if string(header[0:4]) != string(snapshotMagic[:]) {
+		return 0, newCorruptError("bad magic of snapshot")
+	}
+	if v := binary.BigEndian.Uint32(header[4:]); v != snapshotVersion {
+		return 0, newConfigError("unsupported snapshot version %d, expected %d", v, snapshotVersion)
+	}
+	if s := binary.BigEndian.Uint32(header[8:]); s != source {
+		return 0, newConfigError("stale snapshot of source %08x, expected %08x", s, source)
+	}
+	count := binary.BigEndian.Uint64(header[16:])
+
+	entry := make([]byte, 8)
+	for i := uint64(0); i < count; i++ {
+		if left < 4+posSize {
+			return 0, newCorruptError("snapshot ends at key %d of %d", i, count)
+		}
+		if _, err := io.ReadFull(r, entry[0:4]); err != nil {
+			return 0, ioError(errors.Wrap(err, "failed reading snapshot"))
+		}
+		keySize := uint64(binary.BigEndian.Uint32(entry))
+		if keySize > left-4-posSize {
+			return 0, newCorruptError("key size %d of snapshot overflow at key %d", keySize, i)
+		}
+		key := make([]byte, keySize)
+		if _, err := io.ReadFull(r, key); err != nil {
+			return 0, ioError(errors.Wrap(err, "failed reading snapshot"))
+		}
+		crc.Write(entry[0:4])
+		crc.Write(key)
+		if _, err := io.ReadFull(r, entry); err != nil {
+			return 0, ioError(errors.Wrap(err, "failed reading snapshot"))
+		}
+		crc.Write(entry)
+		left -= 4 + keySize + posSize
+		index.Insert(key, Pos(binary.BigEndian.Uint64(entry)))
+	}
+	if left != 0 {
+		return 0, newCorruptError("snapshot has %d bytes after %d keys", left, count)
+	}
+	if _, err := io.ReadFull(r, entry[0:checksumSize]); err != nil {
+		return 0, ioError(errors.Wrap(err, "failed reading snapshot"))
+	}
+	if crc.Sum32() != binary.BigEndian.Uint32(entry) {
+		return 0, newCorruptError("snapshot checksum mismatch")
+	}
+	return count, nil
+}
@@ -0,0 +1,94 @@
+package internal
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// entry of sorted index, off is the offset of key in arena
+type sortedEntry struct {
+	off uint64
+	pos Pos
+}
+
+// sorted array of keys searched by binary search
+//
+// inserts are appended, the array is sorted once by the first read
+// after them, so building it costs one sort, keys are iterated in order.
+// db sorts it when loading is done, see ShardedIndex.build
+type sortedIndex struct {
+	entries []sortedEntry
+	arena   keyArena
+	// 1 if entries are sorted, mu guards sorting
+	sorted int32
+	mu     sync.Mutex
+}
+
+func newSortedIndex() *sortedIndex {
+	return &sortedIndex{sorted: 1}
+}
+
+func (x *sortedIndex) Insert(key []byte, pos Pos) {
+	x.entries = append(x.entries, sortedEntry{off: x.arena.add(key), pos: pos})
+	atomic.StoreInt32(&x.sorted, 0)
+}
+
+// sort entries if any is inserted since last sort,
+// of entries of the same key the one inserted last is kept
+func (x *sortedIndex) sort() {
+	if atomic.LoadInt32(&x.sorted) == 1 {
+		return
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.sorted == 1 {
+		return
+	}
+	sort.SliceStable(x.entries, func(i, j int) bool {
+		return bytes.Compare(x.arena.key(x.entries[i].off), x.arena.key(x.entries[j].off)) < 0
+	})
+	n := 0
+	for i, e := range x.entries {
+		if n > 0 && bytes.Equal(x.arena.key(x.entries[n-1].off), x.arena.key(e.off)) {
+			x.entries[n-1] = e
+			continue
+		}
+		x.entries[n] = x.entries[i]
+		n++
+	}
+	x.entries = x.entries[:n]
+	atomic.StoreInt32(&x.sorted, 1)
+}
+
+func (x *sortedIndex) Search(key []byte) (Pos, bool) {
+	x.sort()
+	i := sort.Search(len(x.entries), func(i int) bool {
+		return bytes.Compare(x.arena.key(x.entries[i].off), key) >= 0
+	})
+	if i < len(x.entries) && bytes.Equal(x.arena.key(x.entries[i].off), key) {
+		return x.entries[i].pos, true
+	}
+	return 0, false
+}
+
+func (x *sortedIndex) Iterate(fn func(key []byte, pos Pos) bool) {
+	x.sort()
+	for _, e := range x.entries {
+		if !fn(x.arena.key(e.off), e.pos) {
+			return
+		}
+	}
+}
+
+func (x *sortedIndex) Len() int {
+	x.sort()
+	return len(x.entries)
+}
+
+func (x *sortedIndex) MemoryUsage() uint64 {
+	x.sort()
+	return uint64(cap(x.entries))*uint64(unsafe.Sizeof(sortedEntry{})) + x.arena.size()
+}
@@ -0,0 +1,153 @@
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	storeLockFile    = "LOCK"
+	storeCurrentFile = "CURRENT"
+	storeTmpPrefix   = "tmp-"
+	storeBuildPrefix = "build-"
+)
+
+// a store dir has the builds of index, CURRENT names the one in use
+//
+//   LOCK                      held by the indexer building the store
+//   CURRENT                   name of the current build
+//   build-<unix nano>/        segments of a build, see segment.go
+//   tmp-<random>/             a build in progress
+//
+// a build is written into a tmp dir, fsynced and renamed to a build dir,
+// then CURRENT is replaced by rename, so an interrupted build never
+// touches the current one, and a reader always sees a complete build
+
+// path of the current build in store dir
+func currentBuildDir(dir string) (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, storeCurrentFile))
+	if err != nil {
+		return "", ioError(errors.Wrapf(err, "failed reading current build of store dir %s", dir))
+	}
+	name := strings.TrimSpace(string(data))
+	if !strings.HasPrefix(name, storeBuildPrefix) || strings.ContainsRune(name, filepath.Separator) {
+		return "", newCorruptError("invalid current build '%s' of store dir %s", name, dir)
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// create a tmp dir in store dir for a new build,
+// the tmp dirs left by interrupted builds are removed,
+// the caller must hold the lock of store
+func newBuildDir(dir string) (string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", ioError(errors.Wrap(err, "failed reading store dir"))
+	}
+	for _, info := range infos {
+		if info.IsDir() && strings.HasPrefix(info.Name(), storeTmpPrefix) {
+			if err := os.RemoveAll(filepath.Join(dir, info.Name())); err != nil {
+				return "", ioError(errors.Wrap(err, "failed removing interrupted build"))
+			}
+		}
+	}
+	tmp, err := ioutil.TempDir(dir, storeTmpPrefix)
+	if err != nil {
+		return "", ioError(errors.Wrap(err, "failed creating build dir"))
+	}
+	return tmp, nil
+}
+
+// make the build in tmp dir the current build of store dir,
+// the builds before it are removed,
+// the caller must hold the lock of store
+func commitBuildDir(dir, tmp string) error {
+	name := storeBuildPrefix + strconv.FormatInt(time.Now().UnixNano(), 10)
+	if err := syncDir(tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, name)); err != nil {
+		return ioError(errors.Wrap(err, "failed renaming build dir"))
+	}
+
+	// replace CURRENT by rename
+	current := filepath.Join(dir, storeCurrentFile)
+	f, err := os.OpenFile(current+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return ioError(errors.Wrap(err, "failed creating current build file"))
+	}
+	if _, err := f.WriteString(name + "\n"); err != nil {
+		f.Close()
+		return ioError(errors.Wrap(err, "failed writing current build file"))
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return ioError(errors.Wrap(err, "failed syncing current build file"))
+	}
+	if err := f.Close(); err != nil {
+		return ioError(errors.Wrap(err, "failed closing current build file"))
+	}
+	if err := os.Rename(current+".tmp", current); err != nil {
+		return ioError(errors.Wrap(err, "failed replacing current build file"))
+	}
+	if err := syncDir(dir); err != nil {
+		return err
+	}
+
+	// a server may still read the old builds, the files removed
+	// stay readable until they are unmapped
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return ioError(errors.Wrap(err, "failed reading store dir"))
+	}
+	for _, info := range infos {
+		if info.IsDir() && strings.HasPrefix(info.Name(), storeBuildPrefix) && info.Name() != name {
+			if err := os.RemoveAll(filepath.Join(dir, info.Name())); err != nil {
+				return ioError(errors.Wrap(err, "failed removing old build"))
+			}
+		}
+	}
+	return nil
+}
+
+// fsync a dir, so the entries created or renamed in it are durable
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return ioError(errors.Wrap(err, "failed opening dir"))
+	}
+	defer f.Close()
+	if err := f.Sync(); err != nil {
+		return ioError(errors.Wrapf(err, "failed syncing dir %s", dir))
+	}
+	return nil
+}
+
+// lock of a store dir, only one indexer may build a store at a time
+type StoreLock struct {
+	f *os.File
+}
+
+// lock store dir, it is created if not exists
+// fail at once if the store is locked by another indexer
+func LockStore(dir string) (*StoreLock, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, ioError(errors.Wrap(err, "failed creating store dir"))
+	}
+	path := filepath.Join(dir, storeLockFile)
+	f, err := lockFile(path)
+	if err != nil {
+		return nil, ioError(errors.Wrapf(err, "failed locking store dir %s, is another indexer running", dir))
+	}
+	return &StoreLock{f: f}, nil
+}
+
+func (l *StoreLock) Unlock() error {
+	return unlockFile(l.f)
+}
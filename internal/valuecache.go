@@ -0,0 +1,289 @@
+package internal
+
+import (
+	"container/list"
+	"hash/maphash"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	defaultValueCacheSize = 256 * 1024 * 1024
+	valueCacheItemSize    = 1024
+	valueCacheItemCost    = 64
+	sketchDepth           = 4
+	sketchMaxCount        = 15
+	sketchMinWidth        = 1024
+	sketchSampleRatio     = 10
+	doorkeeperRatio       = 16
+)
+
+// count-min sketch with 4 bit counters, it estimates the frequency of keys
+// all counters are halved after sampleSize increments, so old keys decay
+type cmSketch struct {
+	rows       [sketchDepth][]uint8
+	mask       uint64
+	additions  uint64
+	sampleSize uint64
+}
+
+func newCmSketch(width uint64) *cmSketch {
+	s := &cmSketch{
+		mask:       width - 1,
+		sampleSize: width * sketchSampleRatio,
+	}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s
+}
+
+// index of hash in row i, the rows use different hashes derived from h
+func (s *cmSketch) index(h uint64, i int) uint64 {
+	return (h + uint64(i)*(h>>32|h<<32|1)) & s.mask
+}
+
+// increase frequency of h, return true if the sketch is reset
+func (s *cmSketch) increment(h uint64) bool {
+	for i := range s.rows {
+		idx := s.index(h, i)
+		if s.rows[i][idx] < sketchMaxCount {
+			s.rows[i][idx]++
+		}
+	}
+	s.additions++
+	if s.additions < s.sampleSize {
+		return false
+	}
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			s.rows[i][j] >>= 1
+		}
+	}
+	s.additions /= 2
+	return true
+}
+
+func (s *cmSketch) estimate(h uint64) uint8 {
+	min := uint8(sketchMaxCount)
+	for i := range s.rows {
+		if c := s.rows[i][s.index(h, i)]; c < min {
+			min = c
+		}
+	}
+	return min
+}
+
+// bloom filter in front of the sketch
+// a key accessed once only sets its bits here, so one-hit wonders
+// do not take space in the sketch
+type doorkeeper struct {
+	bits []uint64
+	mask uint64
+}
+
+func newDoorkeeper(width uint64) *doorkeeper {
+	return &doorkeeper{
+		bits: make([]uint64, width/64),
+		mask: width - 1,
+	}
+}
+
+// set bits of h, return true if they are all set before
+func (d *doorkeeper) add(h uint64) bool {
+	found := true
+	for _, idx := range [2]uint64{h & d.mask, (h >> 32) & d.mask} {
+		if d.bits[idx/64]&(1<<(idx%64)) == 0 {
+			found = false
+			d.bits[idx/64] |= 1 << (idx % 64)
+		}
+	}
+	return found
+}
+
+func (d *doorkeeper) contains(h uint64) bool {
+	for _, idx := range [2]uint64{h & d.mask, (h >> 32) & d.mask} {
+		if d.bits[idx/64]&(1<<(idx%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *doorkeeper) reset() {
+	for i := range d.bits {
+		d.bits[i] = 0
+	}
+}
+
+type cacheItem struct {
+	key   string
+	value []byte
+	hash  uint64
+}
+
+type ValueCacheStats struct {
+	Size    uint64
+	Used    uint64
+	Items   uint64
+	Hits    uint64
+	Misses  uint64
+	Admits  uint64
+	Rejects uint64
+	Evicts  uint64
+}
+
+// cache of hot values in front of Db.Get
+//
+// items are kept in LRU order within a byte budget,
+// a new item is admitted by TinyLFU: when the cache is full,
+// it must be estimated more frequent than the items it would evict.
+// the frequency of every access, hit or miss, is recorded
+// in a doorkeeper and a count-min sketch
+//
+// values returned are shared with the cache and must not be modified
+type ValueCache struct {
+	mu     sync.Mutex
+	size   uint64
+	used   uint64
+	seed   maphash.Seed
+	sketch *cmSketch
+	door   *doorkeeper
+	items  map[string]*list.Element
+	lru    *list.List
+
+	hits    uint64
+	misses  uint64
+	admits  uint64
+	rejects uint64
+	evicts  uint64
+}
+
+// size is the memory budget of the cache in bytes, 0 disables it
+func NewValueCache(size uint64) *ValueCache {
+	width := uint64(sketchMinWidth)
+	for width < size/valueCacheItemSize {
+		width <<= 1
+	}
+
+	return &ValueCache{
+		size:   size,
+		seed:   maphash.MakeSeed(),
+		sketch: newCmSketch(width),
+		door:   newDoorkeeper(width * doorkeeperRatio),
+		items:  make(map[string]*list.Element),
+		lru:    list.New(),
+	}
+}
+
+func (c *ValueCache) hash(key string) uint64 {
+	var h maphash.Hash
+	h.SetSeed(c.seed)
+	h.WriteString(key)
+	return h.Sum64()
+}
+
+// record an access of key, must hold the lock
+func (c *ValueCache) record(h uint64) {
+	if !c.door.add(h) {
+		return
+	}
+	if c.sketch.increment(h) {
+		c.door.reset()
+	}
+}
+
+// estimated frequency of key, must hold the lock
+func (c *ValueCache) frequency(h uint64) uint8 {
+	f := c.sketch.estimate(h)
+	if c.door.contains(h) {
+		f++
+	}
+	return f
+}
+
+func itemCost(key string, value []byte) uint64 {
+	return uint64(len(key)+len(value)) + valueCacheItemCost
+}
+
+func (c *ValueCache) Get(key string) ([]byte, bool) {
+	if c.size == 0 {
+		return nil, false
+	}
+	h := c.hash(key)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.record(h)
+	e, ok := c.items[key]
+	if !ok {
+		atomic.AddUint64(&c.misses, 1)
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	atomic.AddUint64(&c.hits, 1)
+	return e.Value.(*cacheItem).value, true
+}
+
+// add a value read from disk, the access is already recorded by Get
+func (c *ValueCache) Add(key string, value []byte) {
+	cost := itemCost(key, value)
+	if cost > c.size {
+		return
+	}
+	h := c.hash(key)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.items[key]; ok {
+		return
+	}
+
+	// the candidate must beat every victim it evicts
+	if c.used+cost > c.size {
+		freq := c.frequency(h)
+		need := c.used + cost - c.size
+		for e := c.lru.Back(); need > 0; e = e.Prev() {
+			victim := e.Value.(*cacheItem)
+			if c.frequency(victim.hash) >= freq {
+				atomic.AddUint64(&c.rejects, 1)
+				return
+			}
+			victimCost := itemCost(victim.key, victim.value)
+			if victimCost >= need {
+				break
+			}
+			need -= victimCost
+		}
+		for c.used+cost > c.size {
+			e := c.lru.Back()
+			victim := e.Value.(*cacheItem)
+			c.lru.Remove(e)
+			delete(c.items, victim.key)
+			c.used -= itemCost(victim.key, victim.value)
+			atomic.AddUint64(&c.evicts, 1)
+		}
+	}
+
+	c.items[key] = c.lru.PushFront(&cacheItem{key: key, value: value, hash: h})
+	c.used += cost
+	atomic.AddUint64(&c.admits, 1)
+}
+
+func (c *ValueCache) Stats() ValueCacheStats {
+	c.mu.Lock()
+	used := c.used
+	items := uint64(len(c.items))
+	c.mu.Unlock()
+
+	return ValueCacheStats{
+		Size:    c.size,
+		Used:    used,
+		Items:   items,
+		Hits:    atomic.LoadUint64(&c.hits),
+		Misses:  atomic.LoadUint64(&c.misses),
+		Admits:  atomic.LoadUint64(&c.admits),
+		Rejects: atomic.LoadUint64(&c.rejects),
+		Evicts:  atomic.LoadUint64(&c.evicts),
+	}
+}
@@ -5,8 +5,11 @@ import (
 
 	"bufio"
 	"encoding/binary"
+	"hash"
+	"hash/crc32"
 	"io"
 	"os"
+	"sort"
 
 	"github.com/pkg/errors"
 )
@@ -16,17 +19,48 @@ const (
 	defaultValPageSize     = 64 * 1024 * 1024
 	defaultValfileFilename = "%09d.val"
 	valHeaderSize          = 8 * 2
-	valFilePath            = "/tmp/00000000.val"
+	valEntrySize           = 8 * 2
+	valReadGapSize         = 64 * 1024
+	valLargeMarker         = ^uint64(0)
+	valLargeHeaderSize     = 8 * 2
 )
 
+// a page read for buffer pool starts a large object, see ReadPage
+var errLargePage = errors.New("page of large value")
+
 // value page struct
 // default 64mb
-// 
 //
-// +--------+----------+------------+--------+
-// | count  | valSizes | valOffsets |  buf   |
-// | uint64 | []uint64 |  []uint64  | []byte |
-// +--------+----------+------------+--------+
+// every value has an entry of valSize and valOffset in the header,
+// values are stored from the end of the page backwards,
+// so the offset of a value is known as soon as it is appended
+// and does not move when more entries are added
+//
+// valOffset is relative to the start of the page
+//
+// +--------+------------------------+------+--------+----------+
+// | count  |        entries         | free |  buf   | checksum |
+// | uint64 | [](valSize, valOffset) |      | []byte |  uint32  |
+// |        |   (uint64, uint64)     |      |        |          |
+// +--------+------------------------+------+--------+----------+
+//
+// checksum is the crc32c of the page before it, it is verified when
+// the whole page is read. a value is mostly read alone, so every value
+// in buf is preceded by the crc32c of the value
+//
+// +----------+--------+
+// | checksum | value  |
+// |  uint32  | []byte |
+// +----------+--------+
+//
+// a value too large for a page is stored as a large object,
+// it starts at a page boundary and spans as many pages as it needs,
+// the marker takes the place of count, checksum is the crc32c of value
+//
+// +--------+---------+--------+----------+----------------------+
+// | marker | valSize | value  | checksum |       padding        |
+// | uint64 | uint64  | []byte |  uint32  | continues next pages |
+// +--------+---------+--------+----------+----------------------+
 type ValPage struct {
 	pageSize   uint64
 	usedSize   uint64
@@ -39,8 +73,8 @@ type ValPage struct {
 
 func NewValPage(pageSize uint64) (*ValPage, error) {
 
-	usedSize := uint64(8)
-	bufOffset := uint64(0)
+	usedSize := uint64(defaultHeaderValSize + checksumSize)
+	bufOffset := pageSize - checksumSize
 
 	count := uint64(0)
 	valSizes := make([]uint64, 0)
@@ -59,56 +93,169 @@ func NewValPage(pageSize uint64) (*ValPage, error) {
 }
 
 // append a value item
-func (p *ValPage) Append(valSize uint64, val []byte) error {
-	if valSize+valHeaderSize+p.usedSize > p.pageSize {
-		return errors.New("overflow")
+// return the offset of the value in the page
+func (p *ValPage) Append(valSize uint64, val []byte) (uint64, error) {
+	if valSize+valHeaderSize+checksumSize+p.usedSize > p.pageSize {
+		return 0, errors.New("overflow")
 	}
 
-	copy(p.buf[p.bufOffset:p.bufOffset+valSize], val)
+	p.bufOffset -= valSize
+	valOffset := p.bufOffset
+	copy(p.buf[valOffset:valOffset+valSize], val)
+	p.bufOffset -= checksumSize
+	binary.BigEndian.PutUint32(p.buf[p.bufOffset:valOffset], checksum(val[0:valSize]))
 	p.valSizes = append(p.valSizes, valSize)
-	p.valOffsets = append(p.valOffsets, p.bufOffset)
+	p.valOffsets = append(p.valOffsets, valOffset)
 
 	p.count++
-	p.bufOffset += valSize
-	p.usedSize += valSize + valHeaderSize
-	return nil
+	p.usedSize += valSize + valHeaderSize + checksumSize
+	return valOffset, nil
+}
+
+func (p *ValPage) Empty() bool {
+	return p.count == 0
+}
+
+// whether a value fits in an empty page, or must be a large object
+func (p *ValPage) Fits(valSize uint64) bool {
+	return valSize+valHeaderSize+checksumSize*2+defaultHeaderValSize <= p.pageSize
+}
+
+// offset of the entry of the i-th value in the page
+func valEntryOffset(i uint64) uint64 {
+	return defaultHeaderValSize + i*valEntrySize
+}
+
+// number of pages taken by a large object
+func valLargePages(valSize, pageSize uint64) uint64 {
+	return (valLargeHeaderSize + valSize + checksumSize + pageSize - 1) / pageSize
+}
+
+// a value record on disk, the value and its checksum
+type valRecord struct {
+	off   uint64
+	size  uint64
+	large bool
+}
+
+// offset and size of the record, the checksum of a value in page is
+// before it, the checksum of a large object is after it
+func (rec valRecord) span() (uint64, uint64) {
+	if rec.large {
+		return rec.off, rec.size + checksumSize
+	}
+	return rec.off - checksumSize, rec.size + checksumSize
+}
+
+// verify the record in buf, which is read at span,
+// and return the value in it
+func (rec valRecord) value(buf []byte) ([]byte, error) {
+	var val, sum []byte
+	if rec.large {
+		val, sum = buf[0:rec.size:rec.size], buf[rec.size:]
+	} else {
+		end := checksumSize + rec.size
+		val, sum = buf[checksumSize:end:end], buf[0:checksumSize]
+	}
+	if err := verifyChecksum(val, sum, "value", rec.off); err != nil {
+		return nil, err
+	}
+	return val, nil
 }
 
+// the file header is written when the writer is closed
+//
+// crc is the checksum of pages, checksum is the checksum of whole file,
+// which is set when the writer is closed
 type ValPageWriter struct {
-	f      *os.File
-	enc    *ValEncoder
-	offset uint32
+	f        *os.File
+	enc      *ValEncoder
+	offset   uint64
+	header   *FileHeader
+	crc      hash.Hash32
+	checksum uint32
 }
 
-func NewValPageWriter(path string) (*ValPageWriter, error) {
+func NewValPageWriter(path string, pageSize uint64) (*ValPageWriter, error) {
 
-	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
-	w := bufio.NewWriter(f)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0640)
+	if err != nil {
+		return &ValPageWriter{}, ioError(err)
+	}
+	// reserve space of header
+	if _, err := f.Write(make([]byte, fileHeaderSize)); err != nil {
+		f.Close()
+		return &ValPageWriter{}, ioError(errors.Wrap(err, "failed writing value file header"))
+	}
+	crc := crc32.New(crcTable)
+	w := bufio.NewWriter(io.MultiWriter(f, crc))
 
-	offset := uint32(0)
+	offset := uint64(0)
 	enc := NewValEncoder(w)
+	header := newFileHeader(valFileMagic, pageSize)
 
 	return &ValPageWriter{
 		f:      f,
 		enc:    enc,
 		offset: offset,
+		header: header,
+		crc:    crc,
 	}, nil
 }
 
-func (pw *ValPageWriter) Write(p *ValPage) (uint32, uint32, error) {
+// write a page to disk
+// return the offset of file after write and the size written
+func (pw *ValPageWriter) Write(p *ValPage) (uint64, uint64, error) {
 	if pw.f == nil {
 		return 0, 0, errors.New("file error")
 	}
 
 	n, err := pw.enc.Encode(p)
 	if err != nil {
-		return 0, 0, err
+		return 0, 0, ioError(err)
+	}
+	pw.offset += n
+	pw.header.RecordCount += p.count
+
+	return pw.offset, n, nil
+}
+
+// write a large object of valSize bytes read from r
+// return the offset of file after write and the size written
+func (pw *ValPageWriter) WriteLarge(valSize, pageSize uint64, r io.Reader) (uint64, uint64, error) {
+	if pw.f == nil {
+		return 0, 0, errors.New("file error")
+	}
+
+	n, err := pw.enc.EncodeLarge(valSize, pageSize, r)
+	if err != nil {
+		return 0, 0, ioError(err)
 	}
 	pw.offset += n
+	pw.header.RecordCount++
 
 	return pw.offset, n, nil
 }
 
+// write file header, sync and close file
+func (pw *ValPageWriter) Close() error {
+	if pw.f == nil {
+		return errors.New("file error")
+	}
+	pw.header.PageCount = pw.offset / pw.header.PageSize
+	header := pw.header.encode()
+	if _, err := pw.f.WriteAt(header, 0); err != nil {
+		pw.f.Close()
+		return ioError(errors.Wrap(err, "failed writing value file header"))
+	}
+	pw.checksum = combineChecksum(checksum(header), pw.crc.Sum32(), pw.offset)
+	if err := pw.f.Sync(); err != nil {
+		pw.f.Close()
+		return ioError(errors.Wrap(err, "failed syncing value file"))
+	}
+	return ioError(pw.f.Close())
+}
+
 type ValEncoder struct {
 	w *bufio.Writer
 }
@@ -118,109 +265,272 @@ func NewValEncoder(w io.Writer) *ValEncoder {
 }
 
 // encode value data to disk format
-func (e *ValEncoder) Encode(p *ValPage) (uint32, error) {
-	headerBuf := make([]byte, 8)
+func (e *ValEncoder) Encode(p *ValPage) (uint64, error) {
+	h := crc32.New(crcTable)
+	w := io.MultiWriter(e.w, h)
+	headerBuf := make([]byte, valEntrySize)
 	binary.BigEndian.PutUint64(headerBuf, p.count)
-	if _, err := e.w.Write(headerBuf); err != nil {
+	if _, err := w.Write(headerBuf[0:defaultHeaderValSize]); err != nil {
 		return 0, errors.Wrap(err, "failed writing value header count")
 	}
 	for i := uint64(0); i < p.count; i++ {
 		binary.BigEndian.PutUint64(headerBuf, p.valSizes[i])
-		if _, err := e.w.Write(headerBuf); err != nil {
-			return 0, errors.Wrap(err, "failed writing value header valueSize")
-		}
-	}
-	for i := uint64(0); i < p.count; i++ {
-		binary.BigEndian.PutUint64(headerBuf, p.valOffsets[i])
-		if _, err := e.w.Write(headerBuf); err != nil {
-			return 0, errors.Wrap(err, "failed writing value header valueOffset")
+		binary.BigEndian.PutUint64(headerBuf[defaultHeaderValSize:], p.valOffsets[i])
+		if _, err := w.Write(headerBuf); err != nil {
+			return 0, errors.Wrap(err, "failed writing value header entry")
 		}
 	}
 
-	// page alignment
-	baseOff := defaultHeaderValSize + p.count*2*defaultHeaderValSize
-	if _, err := e.w.Write(p.buf[0 : defaultValPageSize-baseOff]); err != nil {
+	// free space and values, the header part of buf is never used
+	if _, err := w.Write(p.buf[valEntryOffset(p.count) : p.pageSize-checksumSize]); err != nil {
 		return 0, errors.Wrap(err, "failed writing value buf")
 	}
+	binary.BigEndian.PutUint32(headerBuf, h.Sum32())
+	if _, err := e.w.Write(headerBuf[0:checksumSize]); err != nil {
+		return 0, errors.Wrap(err, "failed writing value page checksum")
+	}
 	if err := e.w.Flush(); err != nil {
 		return 0, errors.Wrap(err, "failed flushing value page")
 	}
 
-	return uint32(1), nil
+	return uint64(p.pageSize), nil
+}
+
+// encode a large object to disk format, padded to page boundary
+func (e *ValEncoder) EncodeLarge(valSize, pageSize uint64, r io.Reader) (uint64, error) {
+	headerBuf := make([]byte, valLargeHeaderSize)
+	binary.BigEndian.PutUint64(headerBuf, valLargeMarker)
+	binary.BigEndian.PutUint64(headerBuf[defaultHeaderValSize:], valSize)
+	if _, err := e.w.Write(headerBuf); err != nil {
+		return 0, errors.Wrap(err, "failed writing large value header")
+	}
+	h := crc32.New(crcTable)
+	if _, err := io.CopyN(io.MultiWriter(e.w, h), r, int64(valSize)); err != nil {
+		return 0, errors.Wrap(err, "failed writing large value")
+	}
+	binary.BigEndian.PutUint32(headerBuf, h.Sum32())
+	if _, err := e.w.Write(headerBuf[0:checksumSize]); err != nil {
+		return 0, errors.Wrap(err, "failed writing large value checksum")
+	}
+
+	// page alignment
+	n := valLargePages(valSize, pageSize) * pageSize
+	padding := n - valLargeHeaderSize - valSize - checksumSize
+	if _, err := e.w.Write(make([]byte, padding)); err != nil {
+		return 0, errors.Wrap(err, "failed writing large value padding")
+	}
+	if err := e.w.Flush(); err != nil {
+		return 0, errors.Wrap(err, "failed flushing large value")
+	}
+
+	return n, nil
 }
 
+// ValReader is safe for concurrent use,
+// values are read into memory owned by the caller
+// every value is verified against its checksum
+// offsets are relative to the end of file header
 type ValReader struct {
-	reader *mmap.ReaderAt
-	l      uint64
-	buf    []byte
+	reader   *mmap.ReaderAt
+	header   *FileHeader
+	l        uint64
+	pageSize uint64
 }
 
-func NewValReader() (*ValReader, error) {
-	reader, err := mmap.Open(valFilePath)
+// the file is refused if its header is not compatible with pageSize
+func NewValReader(path string, pageSize uint64) (*ValReader, error) {
+	reader, err := mmap.Open(path)
 	if err != nil {
+		return &ValReader{}, ioError(err)
+	}
+	header, l, err := readFileHeader(reader, path, valFileMagic, pageSize)
+	if err != nil {
+		reader.Close()
 		return &ValReader{}, err
 	}
-	l := uint64(reader.Len())
-	buf := make([]byte, defaultValPageSize)
 
 	return &ValReader{
-		reader: reader,
-		l:      l,
-		buf:    buf,
+		reader:   reader,
+		header:   header,
+		l:        l,
+		pageSize: pageSize,
 	}, nil
 }
 
-func (r *ValReader) ReadAt(offset uint64) ([]byte, error) {
-	if offset > r.l {
-		return nil, errors.New("overflow")
+// read len(buf) bytes at offset into buf
+func (r *ValReader) ReadAt(buf []byte, offset uint64) error {
+	if offset+uint64(len(buf)) > r.l {
+		return newCorruptError("value offset %d size %d overflow", offset, len(buf))
 	}
-	n, err := r.reader.ReadAt(r.buf, int64(offset))
-	if err != nil {
-		return nil, err
+	if _, err := r.reader.ReadAt(buf, int64(offset+fileHeaderSize)); err != nil {
+		return ioError(err)
+	}
+	return nil
+}
+
+func (r *ValReader) Header() *FileHeader {
+	return r.header
+}
+
+func (r *ValReader) Close() error {
+	return r.reader.Close()
+}
+
+// decode a value entry at entryOff of the page,
+// return offset and size of the value in the page
+func (r *ValReader) decodeEntry(entry []byte, entryOff uint64) (uint64, uint64, error) {
+	valSize := binary.BigEndian.Uint64(entry)
+	off := binary.BigEndian.Uint64(entry[defaultHeaderValSize:])
+	// a value is always stored after the entries and its checksum
+	if off < entryOff+valEntrySize+checksumSize || off+valSize > r.pageSize-checksumSize {
+		return 0, 0, newCorruptError("value entry offset %d size %d overflow", off, valSize)
+	}
+	return off, valSize, nil
+}
+
+// whether pos is a large object, which starts at a page boundary,
+// the entry of a value in page is always after the count of page
+func (r *ValReader) isLarge(pos Pos) bool {
+	return pos.indirect() && pos.offset()%r.pageSize == 0
+}
+
+// resolve the record of the value at pos
+// a value too large for pos has no size in it, pos is the offset
+// of its entry in the page header, or the start of its large object
+func (r *ValReader) locate(pos Pos) (valRecord, error) {
+	if !pos.indirect() {
+		if pos.offset()%r.pageSize < checksumSize {
+			return valRecord{}, newCorruptError("value offset %d overflow", pos.offset())
+		}
+		return valRecord{off: pos.offset(), size: pos.size()}, nil
+	}
+	entryOff := pos.offset()
+	pageOffset := entryOff - entryOff%r.pageSize
+	var entry [valEntrySize]byte
+	if err := r.ReadAt(entry[:], entryOff); err != nil {
+		return valRecord{}, err
 	}
-	if n == 0 {
-		return nil, errors.New("no data")
+	if binary.BigEndian.Uint64(entry[:]) == valLargeMarker {
+		if entryOff != pageOffset {
+			return valRecord{}, newCorruptError("large value at offset %d not at page boundary", entryOff)
+		}
+		valSize := binary.BigEndian.Uint64(entry[defaultHeaderValSize:])
+		return valRecord{off: entryOff + valLargeHeaderSize, size: valSize, large: true}, nil
 	}
-	return r.buf, nil
+	off, valSize, err := r.decodeEntry(entry[:], entryOff-pageOffset)
+	if err != nil {
+		return valRecord{}, err
+	}
+	return valRecord{off: pageOffset + off, size: valSize}, nil
 }
 
-// read data from disk and get values
-func (r *ValReader) Read(pageOffset, valOffset uint64) ([]byte, error) {
-	buf, err := r.ReadAt(pageOffset)
+// read the value at pos
+// a value is read with one exact size read, together with its checksum
+func (r *ValReader) Read(pos Pos) ([]byte, error) {
+	rec, err := r.locate(pos)
 	if err != nil {
 		return nil, err
 	}
-	kOff := 0
-	tmpBuf := make([]byte, defaultHeaderValSize)
-	copy(tmpBuf, buf[kOff:kOff+defaultHeaderValSize])
-	count := binary.BigEndian.Uint64(tmpBuf)
-	kOff += defaultHeaderValSize
-	if valOffset > count {
-		return nil, errors.New("val offset overflow")
+	off, n := rec.span()
+	buf := make([]byte, n)
+	if err := r.ReadAt(buf, off); err != nil {
+		return nil, err
 	}
+	return rec.value(buf)
+}
 
-	baseOff := defaultHeaderValSize + count*2*defaultHeaderValSize
-	valSizes := make([]uint64, count)
-	valOffsets := make([]uint64, count)
+// read a whole page into buf and verify it, used by buffer pool
+// a page starting a large object returns errLargePage,
+// so the pool drops it and its value is read by Read
+func (r *ValReader) ReadPage(pageId uint64, buf []byte) error {
+	buf = buf[:r.pageSize]
+	offset := pageId * r.pageSize
+	if err := r.ReadAt(buf, offset); err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint64(buf) == valLargeMarker {
+		return errLargePage
+	}
+	end := r.pageSize - checksumSize
+	return verifyChecksum(buf[:end], buf[end:], "value page", offset)
+}
 
-	vals := make([][]byte, count)
-	for i := uint64(0); i < count; i++ {
-		copy(tmpBuf, buf[kOff:kOff+defaultHeaderValSize])
-		valSize := binary.BigEndian.Uint64(tmpBuf)
-		valSizes[i] = valSize
-		kOff += defaultHeaderValSize
+// copy the value at pos out of page, which is read by ReadPage
+func (r *ValReader) PageValue(page []byte, pos Pos) ([]byte, error) {
+	off := pos.offset() % r.pageSize
+	size := pos.size()
+	if pos.indirect() {
+		var err error
+		if off+valEntrySize > uint64(len(page)) {
+			return nil, newCorruptError("value offset %d overflow", pos.offset())
+		}
+		off, size, err = r.decodeEntry(page[off:off+valEntrySize], off)
+		if err != nil {
+			return nil, err
+		}
 	}
-	for i := uint64(0); i < count; i++ {
-		copy(tmpBuf, buf[kOff:kOff+defaultHeaderValSize])
-		valOffset := binary.BigEndian.Uint64(tmpBuf)
-		valOffsets[i] = valOffset
-		kOff += defaultHeaderValSize
+	if off < checksumSize || off+size > uint64(len(page)) {
+		return nil, newCorruptError("value offset %d overflow", pos.offset())
 	}
-	for i := uint64(0); i < count; i++ {
-		valBuf := make([]byte, valSizes[i])
-		copy(valBuf, buf[baseOff+valOffsets[i]:baseOff+valOffsets[i]+valSizes[i]])
-		vals[i] = valBuf
+	rec := valRecord{off: off, size: size}
+	start, n := rec.span()
+	val, err := rec.value(page[start : start+n])
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), val...), nil
+}
+
+// read the values at positions
+// values are read in ascending offset order and values close to each
+// other are read with one read, so a page is scanned at most once,
+// every value returned is allocated on its own
+func (r *ValReader) ReadMany(positions []Pos) ([][]byte, error) {
+	recs := make([]valRecord, len(positions))
+	offs := make([]uint64, len(positions))
+	sizes := make([]uint64, len(positions))
+	order := make([]int, len(positions))
+	for i, pos := range positions {
+		rec, err := r.locate(pos)
+		if err != nil {
+			return nil, err
+		}
+		recs[i] = rec
+		offs[i], sizes[i] = rec.span()
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool { return offs[order[i]] < offs[order[j]] })
+
+	vals := make([][]byte, len(positions))
+	for i := 0; i < len(order); {
+		// merge the following values whose gap is small
+		start := offs[order[i]]
+		end := start + sizes[order[i]]
+		j := i + 1
+		for ; j < len(order) && offs[order[j]] <= end+valReadGapSize; j++ {
+			if offs[order[j]]+sizes[order[j]] > end {
+				end = offs[order[j]] + sizes[order[j]]
+			}
+		}
+		buf := make([]byte, end-start)
+		if err := r.ReadAt(buf, start); err != nil {
+			return nil, err
+		}
+		for _, k := range order[i:j] {
+			off := offs[k] - start
+			val, err := recs[k].value(buf[off : off+sizes[k]])
+			if err != nil {
+				return nil, err
+			}
+			// a value of a shared read is copied out,
+			// so a value kept in cache does not hold the whole read
+			if j-i > 1 {
+				val = append([]byte(nil), val...)
+			}
+			vals[k] = val
+		}
+		i = j
 	}
 
-	return vals[valOffset], nil
+	return vals, nil
 }
@@ -0,0 +1,127 @@
+package internal
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testSparsePageSize = minValPageSize
+
+// write a file of pageCount pages with a valid header, pages holds
+// the encoded pages by offset, the rest of the file is a hole,
+// so a file over 4GB takes only the space of its pages
+func writeSparseFile(t *testing.T, path string, magic [4]byte, pageSize, pageCount, records uint64, pages map[uint64][]byte) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := f.Truncate(int64(fileHeaderSize + pageCount*pageSize)); err != nil {
+		t.Skipf("sparse file not supported: %v", err)
+	}
+	h := newFileHeader(magic, pageSize)
+	h.PageCount = pageCount
+	h.RecordCount = records
+	if _, err := f.WriteAt(h.encode(), 0); err != nil {
+		t.Fatal(err)
+	}
+	for off, page := range pages {
+		if _, err := f.WriteAt(page, int64(fileHeaderSize+off)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// a value segment of the largest size, its last pages
+// are past 4GB of the file as the header is before them
+//
+// a large object takes the 3rd and 2nd pages from the end,
+// the last page has a small value and a value read by its entry
+func TestValReaderSparse(t *testing.T) {
+	pageSize := uint64(testSparsePageSize)
+	pageCount := uint64(posMaxOffset+1) / pageSize
+	largeOff := (pageCount - 3) * pageSize
+	lastOff := (pageCount - 1) * pageSize
+
+	large := bytes.Repeat([]byte("large value "), int(pageSize)/8)
+	var buf bytes.Buffer
+	if _, err := NewValEncoder(&buf).EncodeLarge(uint64(len(large)), pageSize, bytes.NewReader(large)); err != nil {
+		t.Fatal(err)
+	}
+	largePage := append([]byte(nil), buf.Bytes()...)
+	if uint64(len(largePage)) != 2*pageSize {
+		t.Fatalf("large object of %d bytes, want 2 pages", len(largePage))
+	}
+
+	small := []byte("small value at the end of segment")
+	entry := []byte("value read by its entry")
+	page, _ := NewValPage(pageSize)
+	smallOff, _ := page.Append(uint64(len(small)), small)
+	page.Append(uint64(len(entry)), entry)
+	buf.Reset()
+	if _, err := NewValEncoder(&buf).Encode(page); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "000000000.val")
+	writeSparseFile(t, path, valFileMagic, pageSize, pageCount, 3, map[uint64][]byte{
+		largeOff: largePage,
+		lastOff:  buf.Bytes(),
+	})
+	vr, err := NewValReader(path, pageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vr.Close()
+	if fileHeaderSize+lastOff < 1<<32 {
+		t.Fatalf("last page at %d of file is not past 4GB", fileHeaderSize+lastOff)
+	}
+
+	largePos, err := NewIndirectPos(posMaxSegment, largeOff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	smallPos, err := NewPos(posMaxSegment, lastOff+smallOff, uint64(len(small)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entryPos, err := NewIndirectPos(posMaxSegment, lastOff+valEntryOffset(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	positions := []Pos{largePos, smallPos, entryPos}
+	want := [][]byte{large, small, entry}
+
+	for i, pos := range positions {
+		value, err := vr.Read(pos)
+		if err != nil || !bytes.Equal(value, want[i]) {
+			t.Errorf("Read(%x) = %.20q, %v, want %.20q", uint64(pos), value, err, want[i])
+		}
+	}
+	values, err := vr.ReadMany(positions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range positions {
+		if !bytes.Equal(values[i], want[i]) {
+			t.Errorf("ReadMany %d = %.20q, want %.20q", i, values[i], want[i])
+		}
+	}
+
+	pageBuf := make([]byte, pageSize)
+	if err := vr.ReadPage(pageCount-1, pageBuf); err != nil {
+		t.Fatal(err)
+	}
+	for i, pos := range positions[1:] {
+		value, err := vr.PageValue(pageBuf, pos)
+		if err != nil || !bytes.Equal(value, want[i+1]) {
+			t.Errorf("PageValue(%x) = %.20q, %v, want %.20q", uint64(pos), value, err, want[i+1])
+		}
+	}
+
+	if err := vr.ReadAt(make([]byte, 8), lastOff+pageSize-4); err == nil {
+		t.Error("read past the end of segment succeeded")
+	}
+}